@@ -0,0 +1,104 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	macRoleUrl = "auth/mac=%s"
+	// expired entries are pruned once the cache is that big
+	maxRoleEntries = 65536
+	// lookups running at the same time, a MAC missing beyond gets the fallback role
+	maxRoleLookups = 16
+)
+
+type (
+	macRole struct {
+		Role string `json:"role"`
+	}
+	respMacRole struct {
+		Code string  `json:"rcode"`
+		Msg  string  `json:"rmsg"`
+		Data macRole `json:"rdata"`
+	}
+
+	roleEntry struct {
+		role    string // "" for a MAC unknown to the center
+		expires time.Time
+	}
+	// roleCache keeps the roles told by the center, a failed lookup is cached as negative
+	roleCache struct {
+		sync.Mutex
+		entries  map[string]roleEntry
+		inflight map[string]bool
+		ttl      time.Duration
+		negTTL   time.Duration
+	}
+)
+
+func newRoleCache(ttl, negTTL time.Duration) roleCache {
+	return roleCache{
+		entries:  make(map[string]roleEntry),
+		inflight: make(map[string]bool),
+		ttl:      ttl,
+		negTTL:   negTTL,
+	}
+}
+
+// MacRole returns the cached role of mac, "" if there is none, and never waits for the
+// center: a missing or expired entry is looked up in the background, meanwhile the
+// old answer is returned. With maxRoleLookups running it's looked up on a later request.
+// It is an options.RoleLookup.
+func (m *RestClient) MacRole(mac string) string {
+	c := &m.roles
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[mac]
+	if (!ok || time.Now().After(e.expires)) && !c.inflight[mac] {
+		if len(c.inflight) >= maxRoleLookups {
+			log.Debugf("Too many role lookups running, MAC %s is looked up later", mac)
+			return e.role
+		}
+		c.inflight[mac] = true
+		go m.lookupRole(mac)
+	}
+	return e.role
+}
+
+// lookupRole asks the center for the role of mac and caches the answer
+func (m *RestClient) lookupRole(mac string) {
+	var res respMacRole
+	err := m.requestCenter(false, fmt.Sprintf(macRoleUrl, url.PathEscape(mac)), nil, &res)
+
+	c := &m.roles
+	c.Lock()
+	defer c.Unlock()
+	delete(c.inflight, mac)
+	e := roleEntry{role: res.Data.Role, expires: time.Now().Add(c.ttl)}
+	switch {
+	case err != nil:
+		// center unreachable, keep what we knew for a while
+		log.Warningf("Role lookup of MAC %s failed: %v", mac, err)
+		e = roleEntry{role: c.entries[mac].role, expires: time.Now().Add(c.negTTL)}
+	case e.role == "":
+		e.expires = time.Now().Add(c.negTTL)
+	}
+	if len(c.entries) >= maxRoleEntries {
+		c.prune()
+	}
+	c.entries[mac] = e
+	log.Debugf("Role of MAC %s: %q", mac, e.role)
+}
+
+// prune drops the expired entries
+func (c *roleCache) prune() {
+	now := time.Now()
+	for mac, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, mac)
+		}
+	}
+}
@@ -7,27 +7,36 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
+
+	"minidhcp/base"
 )
 
 // RestClient: 从管控中心和其他地方获取
 type (
 	RestClient struct {
-		url string //= "https://ip:port/v1/auth/"
+		url    string //= "https://ip:port/v1/auth/"
+		client *http.Client
+		roles  roleCache
 	}
 )
 
 const (
 	urlHost = "http://%s/"
 	userUrl = "/auth/user/listall"
+
+	defaultCenterTimeout = 2 * time.Second
+	defaultRoleTTL       = 10 * time.Minute
+	defaultRoleNegTTL    = time.Minute
 )
 
 func (m *RestClient) requestCenter(isPost bool, cmd string, param []byte, result interface{}) error {
 	var resp *http.Response
 	var err error
 	if isPost {
-		resp, err = http.Post(m.url+cmd, "Content-type: application/json", bytes.NewBuffer(param))
+		resp, err = m.client.Post(m.url+cmd, "Content-type: application/json", bytes.NewBuffer(param))
 	} else {
-		resp, err = http.Get(m.url + cmd)
+		resp, err = m.client.Get(m.url + cmd)
 	}
 	if err != nil {
 		// log.Error(cmd, log.String("err", err.Error()))
@@ -37,7 +46,7 @@ func (m *RestClient) requestCenter(isPost bool, cmd string, param []byte, result
 	// log.Info("response Status Headers", resp.Status, resp.Header)
 
 	body, _ := ioutil.ReadAll(resp.Body)
-	if !bytes.ContainsAny(body, "QS000000") {
+	if !bytes.Contains(body, []byte("QS000000")) {
 		err = errors.New("Response code error" + string(body))
 	} else {
 		err = json.Unmarshal(body, &result)
@@ -56,6 +65,34 @@ func (m *RestClient) requestCenter(isPost bool, cmd string, param []byte, result
 
 // 启动时，先从控制中心一次性获取加载配置
 func InitByRestClient(ipport string) *RestClient {
-	client := RestClient{fmt.Sprintf(urlHost, ipport)}
+	client := RestClient{
+		url:    fmt.Sprintf(urlHost, ipport),
+		client: &http.Client{Timeout: defaultCenterTimeout},
+		roles:  newRoleCache(defaultRoleTTL, defaultRoleNegTTL),
+	}
 	return &client
 }
+
+// NewRestClient creates the client of the control center in cfg
+func NewRestClient(cfg *base.Config) (*RestClient, error) {
+	client := InitByRestClient(cfg.Center)
+	durations := []struct {
+		name, value string
+		d           *time.Duration
+	}{
+		{"center timeout", cfg.CenterTimeout, &client.client.Timeout},
+		{"role ttl", cfg.RoleTTL, &client.roles.ttl},
+		{"role negative ttl", cfg.RoleNegTTL, &client.roles.negTTL},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", d.name, d.value)
+		}
+		*d.d = v
+	}
+	return client, nil
+}
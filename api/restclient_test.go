@@ -0,0 +1,136 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"minidhcp/base"
+)
+
+// getCenter starts a control center stand-in, roles maps a MAC to its role
+func getCenter(t *testing.T, roles map[string]string, delay time.Duration, calls *int32) *RestClient {
+	center := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		time.Sleep(delay)
+		mac := strings.TrimPrefix(r.URL.Path, "/auth/mac=")
+		role, ok := roles[mac]
+		if !ok {
+			fmt.Fprint(w, `{"rcode":"QS000404","rmsg":"unknown mac","rdata":{}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"rcode":"QS000000","rmsg":"success","rdata":{"role":"%s"}}`, role)
+	}))
+	t.Cleanup(center.Close)
+
+	client, err := NewRestClient(&base.Config{
+		Center:        strings.TrimPrefix(center.URL, "http://"),
+		CenterTimeout: "500ms",
+		RoleTTL:       "1h",
+		RoleNegTTL:    "1h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// waitRole starts a lookup of mac and waits until it's done
+func waitRole(c *RestClient, mac string) string {
+	c.MacRole(mac)
+	for i := 0; i < 100; i++ {
+		c.roles.Lock()
+		_, ok := c.roles.entries[mac]
+		c.roles.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c.MacRole(mac)
+}
+
+func TestMacRole(t *testing.T) {
+	var calls int32
+	c := getCenter(t, map[string]string{"00:00:00:00:00:01": "lab"}, 0, &calls)
+
+	if role := waitRole(c, "00:00:00:00:00:01"); role != "lab" {
+		t.Fatalf("role %q, want lab", role)
+	}
+	// negative answer is cached too
+	if role := waitRole(c, "00:00:00:00:00:02"); role != "" {
+		t.Fatalf("role %q for unknown MAC", role)
+	}
+	c.MacRole("00:00:00:00:00:01")
+	c.MacRole("00:00:00:00:00:02")
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("%d requests to the center, want 2", n)
+	}
+}
+
+func TestMacRoleSlowCenter(t *testing.T) {
+	var calls int32
+	c := getCenter(t, map[string]string{"00:00:00:00:00:01": "lab"}, 200*time.Millisecond, &calls)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if role := c.MacRole("00:00:00:00:00:01"); role != "" {
+			t.Fatalf("role %q before the center answered", role)
+		}
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("MacRole waited for the center")
+	}
+	if role := waitRole(c, "00:00:00:00:00:01"); role != "lab" {
+		t.Fatalf("role %q, want lab", role)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("%d requests to the center, want 1", n)
+	}
+}
+
+func TestMacRoleLookupsBounded(t *testing.T) {
+	var calls int32
+	c := getCenter(t, nil, 200*time.Millisecond, &calls)
+
+	for i := 0; i < 4*maxRoleLookups; i++ {
+		if role := c.MacRole(fmt.Sprintf("00:00:00:00:01:%02x", i)); role != "" {
+			t.Fatalf("role %q, want the fallback", role)
+		}
+	}
+	c.roles.Lock()
+	n := len(c.roles.inflight)
+	c.roles.Unlock()
+	if n != maxRoleLookups {
+		t.Fatalf("%d lookups running, want %d", n, maxRoleLookups)
+	}
+}
+
+func TestMacRoleUnreachable(t *testing.T) {
+	var calls int32
+	c := getCenter(t, nil, 0, &calls)
+	c.url = "http://127.0.0.1:1/"
+	c.roles.entries["00:00:00:00:00:01"] = roleEntry{role: "lab", expires: time.Now().Add(-time.Second)}
+
+	// expired answer is kept while the center is down
+	c.MacRole("00:00:00:00:00:01")
+	for i := 0; i < 100; i++ {
+		c.roles.Lock()
+		e := c.roles.entries["00:00:00:00:00:01"]
+		c.roles.Unlock()
+		if e.expires.After(time.Now()) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if role := c.MacRole("00:00:00:00:00:01"); role != "lab" {
+		t.Fatalf("role %q, want lab", role)
+	}
+	if role := waitRole(c, "00:00:00:00:00:02"); role != "" {
+		t.Fatalf("role %q, want the fallback", role)
+	}
+}
@@ -1,24 +1,29 @@
 package api
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
 	"minidhcp/base"
+	"minidhcp/options"
 
 	restful "github.com/emicklei/go-restful/v3"
 )
 
 var log = base.GetLogger("restserver")
 
+// how long the requests in flight may take to finish on shutdown
+const shutdownTimeout = 5 * time.Second
+
 type (
 	RestServer struct {
-		cfg *base.Config
+		cfg  *base.Config
+		opts *options.Options
+		done chan struct{} // closed once the http server is shut down
 	}
 
 	config struct {
@@ -51,6 +56,61 @@ type (
 	reqStaticRoute struct {
 		Data []ipstatic `json:"rdata"`
 	}
+
+	iplease struct {
+		Mac      string `json:"mac"`
+		ClientId string `json:"clientId"`
+		Ip       string `json:"ip"`
+		Role     string `json:"role"`
+		Expires  int64  `json:"expires"`
+		State    string `json:"state"`
+	}
+	respLease struct {
+		Code string    `json:"rcode"`
+		Msg  string    `json:"rmsg"`
+		Data []iplease `json:"rdata"`
+	}
+
+	ipquarantine struct {
+		Ip      string `json:"ip"`
+		Mac     string `json:"mac"`
+		Role    string `json:"role"`
+		Reason  string `json:"reason"`
+		Expires int64  `json:"expires"`
+	}
+	respQuarantine struct {
+		Code string         `json:"rcode"`
+		Msg  string         `json:"rmsg"`
+		Data []ipquarantine `json:"rdata"`
+	}
+
+	iphost struct {
+		Role      string `json:"role"`
+		Mac       string `json:"mac"`
+		ClientId  string `json:"clientId"`
+		Ip        string `json:"ip"`
+		Hostname  string `json:"hostname"`
+		Dns       string `json:"dns"`
+		Router    string `json:"router"`
+		LeaseTime string `json:"leaseTime"`
+	}
+	reqHost struct {
+		Data []iphost `json:"rdata"`
+	}
+	respHost struct {
+		Code string   `json:"rcode"`
+		Msg  string   `json:"rmsg"`
+		Data []iphost `json:"rdata"`
+	}
+
+	iprole struct {
+		Mac        string `json:"mac"`
+		Role       string `json:"role"`
+		ForceRenew bool   `json:"forceRenew"`
+	}
+	reqRole struct {
+		Data []iprole `json:"rdata"`
+	}
 )
 
 func (r *RestServer) respSuccess(resp *restful.Response) {
@@ -62,6 +122,12 @@ func (r *RestServer) respError(resp *restful.Response, err error) {
 	log.Info("respError", err.Error())
 }
 
+// respInvalid answers a request whose data is invalid
+func (r *RestServer) respInvalid(resp *restful.Response, err error) {
+	resp.WriteError(http.StatusBadRequest, err)
+	log.Info("respInvalid", err.Error())
+}
+
 //设置DHCP服务配置 POST https://ip:port/dhcp/config
 // "rdata": {
 // 		"ifacce": "eth1"
@@ -77,7 +143,10 @@ func (r *RestServer) setConfig(req *restful.Request, resp *restful.Response) {
 	}
 
 	r.cfg.Ifname = cfg.Data.Iface
-	r.cfg.Marshal()
+	if err = r.cfg.Marshal(); err != nil {
+		r.respError(resp, err)
+		return
+	}
 
 	r.respSuccess(resp)
 }
@@ -96,6 +165,7 @@ func (r *RestServer) setConfig(req *restful.Request, resp *restful.Response) {
 // 		"dns1": "192.168.1.100"
 // 	},
 // ]
+// 校验失败返回400，新的IP段在重启后生效
 func (r *RestServer) setRange(req *restful.Request, resp *restful.Response) {
 	rrg := new(reqRange)
 	err := req.ReadEntity(&rrg)
@@ -104,28 +174,35 @@ func (r *RestServer) setRange(req *restful.Request, resp *restful.Response) {
 		return
 	}
 
+	var subs []base.Subnet
 	for _, v := range rrg.Data {
-		rg := r.cfg.Guest
-		if v.Name == "staff" {
-			rg = r.cfg.Staff
-		} else if v.Name == "boss" {
-			rg = r.cfg.Boss
-		}
-
-		ss := strings.Split(v.IpRange, "-")
-		if len(ss) < 2 {
-			r.respError(resp, errors.New("IpRange array length less than 2"))
+		if v.Name == "" {
+			r.respInvalid(resp, errors.New("role name is empty"))
 			return
 		}
-		rg.Role = v.Name
-		rg.IpStart = ss[0]
-		rg.IpStop = ss[1]
-		rg.Dns = v.Dns1
-		rg.Router = v.Gateway
-		rg.Netmask = v.Mask
-		rg.LeaseTime = v.Leasetime
+		// ipRange is "start-stop", several pools are separated by ","
+		var pools []base.Pool
+		for _, s := range strings.Split(v.IpRange, ",") {
+			ss := strings.Split(s, "-")
+			if len(ss) < 2 {
+				r.respInvalid(resp, errors.New("IpRange array length less than 2"))
+				return
+			}
+			pools = append(pools, base.Pool{IpStart: strings.TrimSpace(ss[0]), IpStop: strings.TrimSpace(ss[1])})
+		}
+
+		subs = append(subs, base.Subnet{Role: v.Name, IpStart: pools[0].IpStart, IpStop: pools[0].IpStop,
+			Pools: pools[1:], Dns: v.Dns1, Router: v.Gateway, Netmask: v.Mask, LeaseTime: v.Leasetime})
+	}
+	// checked against the other roles under the lock of opts, which writes the config
+	if err = r.opts.SetRanges(subs); err != nil {
+		r.respInvalid(resp, err)
+		return
+	}
+	if err = r.opts.SaveConfig(); err != nil {
+		r.respError(resp, err)
+		return
 	}
-	r.cfg.Marshal()
 
 	r.respSuccess(resp)
 }
@@ -142,32 +219,157 @@ func (r *RestServer) setStaticRoute(req *restful.Request, resp *restful.Response
 		r.respError(resp, errors.New("static router array length less than 1"))
 		return
 	}
-	l := rsr.Data[0]
-	r.cfg.Staticrouter1 = l.Mac + " " + l.Ip
-	r.cfg.Marshal()
+	for _, l := range rsr.Data {
+		// name is the role, the one whose network holds the IP if it's empty
+		if err = r.opts.AddReservation(l.Name, base.Host{Mac: l.Mac, Ip: l.Ip}); err != nil {
+			r.respError(resp, err)
+			return
+		}
+	}
+	// the reservations are in the config of opts
+	if err = r.opts.SaveConfig(); err != nil {
+		r.respError(resp, err)
+		return
+	}
 
 	r.respSuccess(resp)
 }
 
 //获取租约分配记录 GET
 // https://ip:port/dhcp/lease
+// 出参：{"rcode":"QS000000","rmsg":"success","rdata":[{"mac":"ea:42:a2:4d:ca:66","clientId":"01ea42a24dca66","ip":"10.10.10.100","role":"staff","expires":1659507755,"state":"bound"}]}
 func (r *RestServer) getAllocateLease(req *restful.Request, resp *restful.Response) {
-	file, err := os.OpenFile("lease.txt", os.O_RDONLY, 0444)
+	leases, err := r.opts.Leases()
 	if err != nil {
 		r.respError(resp, err)
+		return
 	}
-	defer file.Close()
 
-	b, err := ioutil.ReadAll(file)
+	rl := respLease{Code: "QS000000", Msg: "success", Data: []iplease{}}
+	for _, l := range leases {
+		rl.Data = append(rl.Data, iplease{l.Mac, l.ClientId, l.IP.String(), l.Role, l.Expires.Unix(), l.State})
+	}
+	resp.WriteAsJson(rl)
+}
+
+//获取被客户端DECLINE或探测到冲突后隔离的IP GET
+// https://ip:port/dhcp/lease/quarantine
+// 出参：{"rcode":"QS000000","rmsg":"success","rdata":[{"ip":"10.10.10.100","mac":"","role":"staff","reason":"abandoned","expires":1659507755}]}
+func (r *RestServer) getQuarantine(req *restful.Request, resp *restful.Response) {
+	rq := respQuarantine{Code: "QS000000", Msg: "success", Data: []ipquarantine{}}
+	for _, q := range r.opts.Quarantined() {
+		rq.Data = append(rq.Data, ipquarantine{q.IP.String(), q.Mac, q.Role, q.Reason, q.Expires.Unix()})
+	}
+	resp.WriteAsJson(rq)
+}
+
+//获取固定IP预留 POST
+// https://ip:port/dhcp/reservation
+// 出参：{"rcode":"QS000000","rmsg":"success","rdata":[{"role":"staff","mac":"00:1a:6d:38:15:ff","clientId":"","ip":"10.10.10.10","hostname":"printer","dns":"","router":"","leaseTime":""}]}
+func (r *RestServer) getReservation(req *restful.Request, resp *restful.Response) {
+	rh := respHost{Code: "QS000000", Msg: "success", Data: []iphost{}}
+	for _, v := range r.opts.Reservations() {
+		h := v.Host
+		rh.Data = append(rh.Data, iphost{v.Role, h.Mac, h.ClientId, h.Ip, h.Hostname, h.Dns, h.Router, h.LeaseTime})
+	}
+	resp.WriteAsJson(rh)
+}
+
+//增加、修改、删除固定IP预留 POST，mac或clientId(option 61)二选一，dns/router/leaseTime覆盖角色的配置
+// https://ip:port/dhcp/reservation/add
+// https://ip:port/dhcp/reservation/update
+// https://ip:port/dhcp/reservation/delete
+// "rdata": [
+// 	{
+// 		"role": "staff" //为空时用IP所在网段的角色
+// 		"mac": "00:1A:6D:38:15:FF"
+// 		"clientId": ""
+// 		"ip": "10.10.10.10"
+// 		"hostname": "printer"
+// 	},
+// ]
+// 出参：{"rcode":"QS000000","rmsg":"success","rdata":"success"}
+func (r *RestServer) addReservation(req *restful.Request, resp *restful.Response) {
+	r.changeReservation(req, resp, func(h iphost) error {
+		return r.opts.AddReservation(h.Role, h.host())
+	})
+}
+
+func (r *RestServer) updateReservation(req *restful.Request, resp *restful.Response) {
+	r.changeReservation(req, resp, func(h iphost) error {
+		return r.opts.UpdateReservation(h.Role, h.host())
+	})
+}
+
+func (r *RestServer) deleteReservation(req *restful.Request, resp *restful.Response) {
+	r.changeReservation(req, resp, func(h iphost) error {
+		return r.opts.DeleteReservation(h.Mac, h.ClientId)
+	})
+}
+
+func (r *RestServer) changeReservation(req *restful.Request, resp *restful.Response, change func(iphost) error) {
+	rh := new(reqHost)
+	err := req.ReadEntity(&rh)
 	if err != nil {
-		log.Fatal(err)
+		r.respError(resp, err)
+		return
 	}
-	s := `{"rcode":"QS000000","rmsg":"success","rdata":"` + string(b) + `"}`
-	resp.WriteAsJson(s)
+
+	for _, v := range rh.Data {
+		if err = change(v); err != nil {
+			r.respError(resp, err)
+			return
+		}
+	}
+	// the reservations are in the config of opts
+	if err = r.opts.SaveConfig(); err != nil {
+		r.respError(resp, err)
+		return
+	}
+
+	r.respSuccess(resp)
 }
 
-func NewRestServer(cfg *base.Config) {
-	r := RestServer{cfg}
+func (h iphost) host() base.Host {
+	return base.Host{Mac: h.Mac, ClientId: h.ClientId, Ip: h.Ip, Hostname: h.Hostname, Dns: h.Dns, Router: h.Router, LeaseTime: h.LeaseTime}
+}
+
+//修改设备角色，释放旧IP，客户端续租时NAK后重新DISCOVER到新角色的IP段，角色写入配置文件，重启后仍然有效 POST
+// https://ip:port/dhcp/lease/role
+// "rdata": [
+// 	{
+// 		"mac": "00:1A:6D:38:15:FF"
+// 		"role": "staff"
+// 		"forceRenew": true //发送FORCERENEW(RFC 3203)让客户端立即续租
+// 	},
+// ]
+// 出参：{"rcode":"QS000000","rmsg":"success","rdata":"success"}
+func (r *RestServer) setRole(req *restful.Request, resp *restful.Response) {
+	rr := new(reqRole)
+	err := req.ReadEntity(&rr)
+	if err != nil {
+		r.respError(resp, err)
+		return
+	}
+
+	for _, v := range rr.Data {
+		if err = r.opts.SetRole(v.Mac, v.Role, "api "+req.Request.RemoteAddr, v.ForceRenew); err != nil {
+			r.respError(resp, err)
+			return
+		}
+	}
+	// the roles are in the config of opts
+	if err = r.opts.SaveConfig(); err != nil {
+		r.respError(resp, err)
+		return
+	}
+
+	r.respSuccess(resp)
+}
+
+// NewRestServer serves the rest api until ctx is done, see Wait
+func NewRestServer(ctx context.Context, cfg *base.Config, opts *options.Options) *RestServer {
+	r := &RestServer{cfg: cfg, opts: opts, done: make(chan struct{})}
 
 	ws := new(restful.WebService)
 	ws.Filter(minidhcpLogging)
@@ -179,17 +381,39 @@ func NewRestServer(cfg *base.Config) {
 	ws.Route(ws.POST("/range").To(r.setRange))
 	ws.Route(ws.POST("/staticroute").To(r.setStaticRoute))
 	ws.Route(ws.POST("/lease").To(r.getAllocateLease))
+	ws.Route(ws.POST("/lease/quarantine").To(r.getQuarantine))
+	ws.Route(ws.POST("/lease/role").To(r.setRole))
+	ws.Route(ws.POST("/reservation").To(r.getReservation))
+	ws.Route(ws.POST("/reservation/add").To(r.addReservation))
+	ws.Route(ws.POST("/reservation/update").To(r.updateReservation))
+	ws.Route(ws.POST("/reservation/delete").To(r.deleteReservation))
 
 	restful.DefaultContainer.Add(ws)
 
 	// log.Info("start listening on ", log.String("ipport", ipport))
 	restport := ":" + cfg.RestPort
+	srv := &http.Server{Addr: restport}
 	fmt.Println("start listening on ", restport)
 	go func() {
-		err := http.ListenAndServe(restport, nil)
+		err := srv.ListenAndServe()
 		fmt.Println("ListenAndServe", err)
 		// log.Fatal("ListenAndServe", log.String("err", err.Error()))
 	}()
+	go func() {
+		defer close(r.done)
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Warningf("Rest server shutdown: %v", err)
+		}
+	}()
+	return r
+}
+
+// Wait waits until the server is shut down
+func (r *RestServer) Wait() {
+	<-r.done
 }
 
 // WebService Filter
@@ -3,24 +3,30 @@ package api
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"minidhcp/base"
+	"minidhcp/options"
+
 	restful "github.com/emicklei/go-restful/v3"
+	"gopkg.in/yaml.v2"
 )
 
 const (
 	bodyCfg = `{"rdata":{"iface":"eth1","match":"ipmac"}}`
-	bodyRg  = `{"rdata":[{"name":"n","vlan":"v","ipstart":"192.168.0.1","ipstop":"192.168.0.2","leasetime":"60s","mask":"","gateway":"","dns1":""}]}`
-	bodySg  = `{"rdata":[{"ip":"192.168.0.1","mac":"00:1A:6D:38:15:FF","name":"60s"}]}`
+	bodyRg  = `{"rdata":[{"name":"n","vlanId":0,"ipRange":"192.168.1.1-192.168.1.2,192.168.1.10-192.168.1.20","leaseTime":"60s","ipMask":"","Gateway":"","dns":""}]}`
+	bodySg  = `{"rdata":[{"ip":"192.168.0.1","mac":"00:1A:6D:38:15:FF","name":"staff"}]}`
 )
 
 var (
-	server RestServer = RestServer{}
-	host   string     = "/dhcp"
+	server RestServer
+	host   string = "/dhcp"
 )
 
 func newReq(cmd, body string) *http.Request {
@@ -51,8 +57,30 @@ func TestMain(m *testing.M) {
 	setHandler("/config", server.setConfig)
 	setHandler("/range", server.setRange)
 	setHandler("/staticroute", server.setStaticRoute)
+	setHandler("/lease", server.getAllocateLease)
+	setHandler("/lease/quarantine", server.getQuarantine)
+	setHandler("/lease/role", server.setRole)
+	setHandler("/reservation", server.getReservation)
+	setHandler("/reservation/add", server.addReservation)
+	setHandler("/reservation/update", server.updateReservation)
+	setHandler("/reservation/delete", server.deleteReservation)
 
-	os.Exit(m.Run())
+	dir, err := ioutil.TempDir("", "minidhcp")
+	if err != nil {
+		panic(err)
+	}
+	subnet := base.Subnet{Role: "staff", IpStart: "192.168.0.1", IpStop: "192.168.0.2", Netmask: "255.255.255.0", LeaseTime: "60s"}
+	server.cfg = &base.Config{Roles: []base.Subnet{subnet}, LeasePath: filepath.Join(dir, "lease.txt"),
+		AuditLog: filepath.Join(dir, "audit.log"), Path: filepath.Join(dir, "minidhcp.yml")}
+	server.opts, err = options.New(server.cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	server.opts.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
 }
 
 func TestSetConfig(t *testing.T) {
@@ -69,6 +97,66 @@ func TestSetRange(t *testing.T) {
 	http.DefaultServeMux.ServeHTTP(resp, req)
 
 	verifyResultSuccess(t, resp)
+	rg := server.cfg.FindRole("n")
+	if rg == nil || len(rg.Ranges()) != 2 {
+		t.Fatalf("role n not set: %+v", rg)
+	}
+
+	// a range overlapping staff, or invalid, sets nothing
+	for _, ipRange := range []string{"192.168.1.1-192.168.1.2,192.168.0.2-192.168.0.9", "192.168.1.2-192.168.1.1"} {
+		body := strings.Replace(bodyRg, "192.168.1.1-192.168.1.2,192.168.1.10-192.168.1.20", ipRange, 1)
+		resp := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(resp, newReq("/range", body))
+		if resp.Code != http.StatusBadRequest {
+			t.Fatalf("range %s: status %d, want 400", ipRange, resp.Code)
+		}
+	}
+	if rg := server.cfg.FindRole("n"); rg == nil || rg.IpStop != "192.168.1.2" || len(rg.Pools) != 1 {
+		t.Fatalf("role n changed: %+v", rg)
+	}
+}
+
+func TestGetAllocateLease(t *testing.T) {
+	req := newReq("/lease", "")
+	resp := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(resp, req)
+
+	verifyResultSuccess(t, resp)
+}
+
+func TestGetQuarantine(t *testing.T) {
+	req := newReq("/lease/quarantine", "")
+	resp := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(resp, req)
+
+	verifyResultSuccess(t, resp)
+}
+
+func TestSetRole(t *testing.T) {
+	req := newReq("/lease/role", `{"rdata":[{"mac":"00:1A:6D:38:15:FF","role":"staff","forceRenew":true}]}`)
+	resp := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(resp, req)
+
+	verifyResultSuccess(t, resp)
+	if role := server.opts.Assigned()["00:1a:6d:38:15:ff"]; role != "staff" {
+		t.Fatalf("role %q, want staff", role)
+	}
+	// the role is written to the config file
+	b, err := ioutil.ReadFile(server.cfg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved base.Config
+	if err := yaml.Unmarshal(b, &saved); err != nil || saved.Assignments["00:1a:6d:38:15:ff"] != "staff" {
+		t.Fatalf("saved assignments %v %v", saved.Assignments, err)
+	}
+
+	req = newReq("/lease/role", `{"rdata":[{"mac":"00:1A:6D:38:15:FF","role":"nosuchrole"}]}`)
+	resp = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(resp, req)
+	if resp.Code == http.StatusOK {
+		t.Fatal("unknown role accepted")
+	}
 }
 
 func TestSetStaticRoute(t *testing.T) {
@@ -78,3 +166,58 @@ func TestSetStaticRoute(t *testing.T) {
 
 	verifyResultSuccess(t, resp)
 }
+
+func TestReservation(t *testing.T) {
+	post := func(cmd, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(resp, newReq(cmd, body))
+		return resp
+	}
+	reserved := func(ip string) bool {
+		for _, r := range server.opts.Reservations() {
+			if r.Host.Mac == "00:00:00:00:00:0a" && r.Host.Ip == ip {
+				return true
+			}
+		}
+		return false
+	}
+
+	verifyResultSuccess(t, post("/reservation/add", `{"rdata":[{"role":"staff","mac":"00:00:00:00:00:0A","ip":"192.168.0.50","hostname":"printer"}]}`))
+	if !reserved("192.168.0.50") {
+		t.Fatal("reservation not added")
+	}
+	// the reservation is written to the config file
+	b, err := ioutil.ReadFile(server.cfg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved base.Config
+	if err := yaml.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	if rg := saved.FindRole("staff"); rg != nil {
+		for _, h := range rg.Hosts {
+			found = found || (h.Mac == "00:00:00:00:00:0a" && h.Ip == "192.168.0.50")
+		}
+	}
+	if !found {
+		t.Fatal("reservation not saved to the config file")
+	}
+	verifyResultSuccess(t, post("/reservation", ""))
+	verifyResultSuccess(t, post("/reservation/update", `{"rdata":[{"mac":"00:00:00:00:00:0a","ip":"192.168.0.51"}]}`))
+	if !reserved("192.168.0.51") || reserved("192.168.0.50") {
+		t.Fatal("reservation not updated")
+	}
+	// not on the network of the role
+	if resp := post("/reservation/update", `{"rdata":[{"role":"staff","mac":"00:00:00:00:00:0a","ip":"10.0.0.1"}]}`); resp.Code == http.StatusOK {
+		t.Fatal("IP out of the subnet accepted")
+	}
+	if !reserved("192.168.0.51") {
+		t.Fatal("reservation lost by a failed update")
+	}
+	verifyResultSuccess(t, post("/reservation/delete", `{"rdata":[{"mac":"00:00:00:00:00:0a"}]}`))
+	if reserved("192.168.0.51") {
+		t.Fatal("reservation not deleted")
+	}
+}
@@ -1,33 +1,101 @@
 package base
 
 import (
+	"errors"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
 )
 
 var log = GetLogger("config")
 
 type (
-	Subnet struct {
-		Role      string `yaml:"role"`
-		IpStart   string `yaml:"ipstart"`
-		IpStop    string `yaml:"ipstop"`
+	Pool struct {
+		IpStart string `yaml:"ipstart"`
+		IpStop  string `yaml:"ipstop"`
+	}
+	// Host is a fixed IP reserved to the client with the MAC or the client-id (option 61),
+	// the options set here override the ones of the role
+	Host struct {
+		Mac       string `yaml:"mac"`
+		ClientId  string `yaml:"clientid"` // hex, like 01:00:1a:6d:38:15:ff
+		Ip        string `yaml:"ip"`
+		Hostname  string `yaml:"hostname"`
 		Dns       string `yaml:"dns"`
 		Router    string `yaml:"router"`
-		Netmask   string `yaml:"netmask"`
 		LeaseTime string `yaml:"leasetime"`
 	}
+	// RateLimit limits how fast new IPs are leased, a rate is "count/duration" like 10/1m,
+	// no limit if empty
+	RateLimit struct {
+		Client string `yaml:"client"` // per chaddr
+		Relay  string `yaml:"relay"`  // per giaddr and circuit-id
+		Role   string `yaml:"role"`   // of all the clients of the role
+	}
+	// Subnet is a role, the clients of a role get their IP from its pools
+	Subnet struct {
+		Role      string    `yaml:"role"`
+		IpStart   string    `yaml:"ipstart"`
+		IpStop    string    `yaml:"ipstop"`
+		Pools     []Pool    `yaml:"pools"`
+		Hosts     []Host    `yaml:"hosts"`
+		Dns       string    `yaml:"dns"`
+		Router    string    `yaml:"router"`
+		Netmask   string    `yaml:"netmask"`
+		LeaseTime string    `yaml:"leasetime"`
+		Limits    RateLimit `yaml:"limits"`
+	}
+	// Rule gives role to the clients matching all its non-empty fields. A pattern matches
+	// case-insensitively, a trailing "*" matches any suffix.
+	Rule struct {
+		Name        string `yaml:"name"`
+		Priority    int    `yaml:"priority"` // higher is tried first
+		Role        string `yaml:"role"`
+		Mac         string `yaml:"mac"`         // MAC or OUI prefix, like 00:1a:2b
+		VendorClass string `yaml:"vendorclass"` // option 60
+		UserClass   string `yaml:"userclass"`   // option 77, any of the user classes
+		Hostname    string `yaml:"hostname"`    // option 12
+		CircuitId   string `yaml:"circuitid"`   // option 82 sub-option 1
+		RemoteId    string `yaml:"remoteid"`    // option 82 sub-option 2
+		Iface       string `yaml:"iface"`       // interface the request came in on
+	}
+	// Interface is served with its own server identifier, its local clients only get
+	// the roles listed
+	Interface struct {
+		Name     string   `yaml:"name"`
+		Roles    []string `yaml:"roles"`    // all roles if empty
+		ServerId string   `yaml:"serverid"` // serverid of the config if empty
+	}
 	Config struct {
-		RestPort      string `yaml:"restport"`
-		Ifname        string `yaml:"ifname"`
-		ServerId      string `yaml:"serverid"`
-		Guest         Subnet `yaml:"guest"`
-		Staff         Subnet `yaml:"staff"`
-		Boss          Subnet `yaml:"boss"`
-		Range1        Subnet `yaml:"range1"`
-		Staticrouter1 string `yaml:"staticrouter1"`
+		RestPort       string            `yaml:"restport"`
+		Ifname         string            `yaml:"ifname"` // served alone if no interfaces are configured
+		Interfaces     []Interface       `yaml:"interfaces"`
+		ServerId       string            `yaml:"serverid"`
+		Quarantine     string            `yaml:"quarantine"`
+		OfferTime      string            `yaml:"offertime"`
+		LeaseGrace     string            `yaml:"leasegrace"`
+		LeaseStore     string            `yaml:"leasestore"` // file, bolt or sqlite
+		LeasePath      string            `yaml:"leasepath"`
+		AuditLog       string            `yaml:"auditlog"` // role changes, audit.log if empty
+		Roles          []Subnet          `yaml:"roles"`
+		Rules          []Rule            `yaml:"rules"`
+		Assignments    map[string]string `yaml:"assignments"`        // roles set by the API, by MAC
+		Center         string            `yaml:"center"`             // control center ip:port, asked for the role of new MACs
+		CenterTimeout  string            `yaml:"centertimeout"`      // timeout of a request to the center
+		RoleTTL        string            `yaml:"rolettl"`            // how long a role told by the center is cached
+		RoleNegTTL     string            `yaml:"rolenegttl"`         // how long an unknown MAC or a failed lookup is cached
+		FallbackRole   string            `yaml:"fallbackrole"`       // role of the MACs no rule matches and the center doesn't know, the first role if empty
+		Probe          string            `yaml:"probe"`              // ping to probe the new IPs before they are offered, none if empty
+		ProbeTimeout   string            `yaml:"probetimeout"`       // how long to wait for a probe answer
+		Workers        int               `yaml:"workers"`            // goroutines handling the requests
+		QueueSize      int               `yaml:"queuesize"`          // requests waiting for a worker, the oldest is dropped beyond
+		RequestTimeout string            `yaml:"requesttimeout"`     // how long a request may wait and be handled
+		Path           string            `yaml:"-" mapstructure:"-"` // file the config was read from, Marshal writes it back there
 	}
 )
 
@@ -45,21 +113,91 @@ func LoadConfig() *Config {
 	if err != nil {
 		log.Printf("unable to decode into config struct, %v", err)
 	}
+	conf.Path = viper.ConfigFileUsed()
 
 	log.Printf("conf: %v", conf)
 	return conf
 }
 
-func (c *Config) Address() net.UDPAddr {
+// Ranges returns the pools of the role, ipstart-ipstop first
+func (s Subnet) Ranges() []Pool {
+	var pools []Pool
+	if s.IpStart != "" || s.IpStop != "" {
+		pools = append(pools, Pool{IpStart: s.IpStart, IpStop: s.IpStop})
+	}
+	return append(pools, s.Pools...)
+}
+
+// FindRole returns the role named name, nil if there is none
+func (c *Config) FindRole(name string) *Subnet {
+	for i := range c.Roles {
+		if c.Roles[i].Role == name {
+			return &c.Roles[i]
+		}
+	}
+	return nil
+}
+
+func (c *Config) Address(ifname string) net.UDPAddr {
 	return net.UDPAddr{
 		IP:   net.IPv4(0, 0, 0, 0),
 		Port: dhcpv4.ServerPort,
-		Zone: c.Ifname,
+		Zone: ifname,
+	}
+}
+
+// Ifaces returns the interfaces to serve, with the server identifier set
+func (c *Config) Ifaces() []Interface {
+	ifaces := c.Interfaces
+	if len(ifaces) == 0 {
+		ifaces = []Interface{{Name: c.Ifname}}
 	}
+	all := make([]Interface, len(ifaces))
+	for i, ifc := range ifaces {
+		if ifc.ServerId == "" {
+			ifc.ServerId = c.ServerId
+		}
+		all[i] = ifc
+	}
+	return all
 }
 
-func (c *Config) Marshal() {
-	if err := viper.SafeWriteConfig(); err != nil {
-		log.Errorf("Config write error: ", err)
+// Marshal writes the config to its Path, a temp file is synced and renamed over the old
+// one so a crash leaves either of them whole
+func (c *Config) Marshal() error {
+	if c.Path == "" {
+		return errors.New("config was not read from a file")
+	}
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(c.Path), filepath.Base(c.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	mode := os.FileMode(0644)
+	if fi, serr := os.Stat(c.Path); serr == nil {
+		mode = fi.Mode()
+	}
+	err = f.Chmod(mode)
+	if err == nil {
+		_, err = f.Write(b)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Errorf("Config write error: %v", err)
+		return err
 	}
+	return nil
 }
@@ -7,12 +7,15 @@ require (
 	github.com/emicklei/go-restful/v3 v3.7.3
 	github.com/google/gopacket v1.1.19
 	github.com/insomniacslk/dhcp v0.0.0-20220504074936-1ca156eafb9f
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/rifflock/lfshook v0.0.0-20180920164130-b9218ef580f5
 	github.com/sirupsen/logrus v1.7.0
 	github.com/spf13/pflag v1.0.6-0.20201009195203-85dd5c8bc61c
 	github.com/spf13/viper v1.7.1
 	github.com/willf/bitset v1.1.11
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -41,6 +44,5 @@ require (
 	golang.org/x/term v0.0.0-20201210144234-2321bbc49cbf // indirect
 	golang.org/x/text v0.3.5 // indirect
 	gopkg.in/ini.v1 v1.62.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
@@ -13,6 +13,8 @@ import (
 
 	"minidhcp/api"
 	"minidhcp/base"
+	"minidhcp/options"
+	"minidhcp/options/prober"
 	"minidhcp/server"
 
 	"github.com/sirupsen/logrus"
@@ -72,10 +74,35 @@ func main() {
 		return
 	}()
 
+	opts, err := options.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer opts.Close()
+	go opts.Reap(ctx)
+
+	// ask the control center for the role of new MACs
+	if cfg.Center != "" {
+		center, err := api.NewRestClient(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.SetRoleLookup(center.MacRole)
+	}
+
+	// probe the new IPs before they are offered
+	if cfg.Probe != "" {
+		p, err := prober.New(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.SetProber(p)
+	}
+
 	// start rest api server
-	go api.NewRestServer(cfg)
+	rest := api.NewRestServer(ctx, cfg, opts)
 
-	srv, err := server.Start(cfg)
+	srv, err := server.Start(ctx, cfg, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -83,8 +110,11 @@ func main() {
 	// for test request
 	// testRequset(cfg.Ifname)
 
-	// run dhcp server
+	// run dhcp server until a signal or a fatal error, then shut the rest api down too;
+	// the lease store is closed last by the deferred opts.Close
 	if err := srv.Wait(); err != nil {
 		log.Print(err)
 	}
+	stop()
+	rest.Wait()
 }
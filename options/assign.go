@@ -0,0 +1,94 @@
+package options
+
+import (
+	"fmt"
+	"net"
+)
+
+// SetRole moves mac to the role name, source tells who asked for it. The lease of mac
+// is dropped and its IP freed, so the next RENEW is NAKed and the client DISCOVERs into
+// the pool of the new role. With forceRenew the client is told to do so right away
+// by a DHCPFORCERENEW (RFC 3203), sent by the subscriber of EventForceRenew. The role
+// is kept in the config too, SaveConfig writes it so it survives a restart.
+func (o *Options) SetRole(mac, name, source string, forceRenew bool) error {
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("malformed hardware address: %s", mac)
+	}
+	mac = hwaddr.String()
+
+	o.admin.Lock()
+	defer o.admin.Unlock()
+	idx, ok := o.findRole(name)
+	if !ok {
+		return fmt.Errorf("unknown role: %s", name)
+	}
+	role := o.roles[idx]
+
+	from := o.assigned[mac]
+	o.assigned[mac] = role.name
+	if o.conf.Assignments == nil {
+		o.conf.Assignments = make(map[string]string)
+	}
+	o.conf.Assignments[mac] = role.name
+	var freed net.IP
+	record, ok := o.recordOf(mac)
+	if ok {
+		from = record.role
+	}
+	if ok && record.held() && record.role != role.name {
+		if err := o.roles[o.roleIndex(record.role)].free(record.IP); err != nil {
+			log.Warningf("Free IP %s for MAC %s: %v", record.IP, mac, err)
+		}
+		o.dropRecord(record.key())
+		freed = record.IP
+	}
+	// the client only holds an IP to renew once it's bound
+	forceRenew = forceRenew && freed != nil && record.state == leaseBound
+
+	o.audit.roleChanged(mac, from, role.name, freed, source, forceRenew)
+	changed := &Record{IP: freed, mac: mac, role: role.name}
+	if ok {
+		changed.clientId = record.clientId
+	}
+	o.emit(EventRoleChanged, changed)
+	if forceRenew {
+		o.emit(EventForceRenew, changed)
+	}
+	return nil
+}
+
+// setupAssigned loads the roles set by SetRole before the last restart
+func (o *Options) setupAssigned() error {
+	o.assigned = make(map[string]string)
+	for mac, name := range o.conf.Assignments {
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return fmt.Errorf("malformed hardware address of assignment: %s", mac)
+		}
+		if _, ok := o.findRole(name); !ok {
+			return fmt.Errorf("assignment of %s to unknown role %s", mac, name)
+		}
+		o.assigned[hwaddr.String()] = name
+	}
+	return nil
+}
+
+// recordOf returns the lease of mac, it may be keyed by the client-id
+func (o *Options) recordOf(mac string) (*Record, bool) {
+	if rec, ok := o.records.get(mac); ok {
+		return rec, true
+	}
+	return o.records.ofMac(mac)
+}
+
+// Assigned returns the roles set by SetRole
+func (o *Options) Assigned() map[string]string {
+	o.admin.RLock()
+	defer o.admin.RUnlock()
+	assigned := make(map[string]string, len(o.assigned))
+	for mac, role := range o.assigned {
+		assigned[mac] = role
+	}
+	return assigned
+}
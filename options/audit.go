@@ -0,0 +1,58 @@
+package options
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// auditLog records the role changes as JSON lines, apart from the debug log
+type auditLog struct {
+	*logrus.Logger
+	file *os.File
+}
+
+func openAudit(path string) (*auditLog, error) {
+	if path == "" {
+		path = "audit.log"
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %w", path, err)
+	}
+	a := newAuditLog(file)
+	a.file = file
+	return a, nil
+}
+
+func newAuditLog(w io.Writer) *auditLog {
+	logger := logrus.New()
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetOutput(w)
+	return &auditLog{Logger: logger}
+}
+
+// roleChanged records that mac was moved from one role to another, ip is the freed IP
+func (a *auditLog) roleChanged(mac, from, to string, ip net.IP, source string, forceRenew bool) {
+	fields := logrus.Fields{
+		"mac":        mac,
+		"from":       from,
+		"to":         to,
+		"source":     source,
+		"forcerenew": forceRenew,
+	}
+	if ip != nil {
+		fields["freed"] = ip.String()
+	}
+	a.WithFields(fields).Info("role changed")
+}
+
+func (a *auditLog) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
@@ -0,0 +1,175 @@
+package options
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"minidhcp/base"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// RoleLookup returns the role of mac, "" if it's not known (yet). It's called on the
+// packet path, so it must answer right away and do any slow lookup in the background.
+type RoleLookup func(mac string) string
+
+// SetRoleLookup makes the new clients no rule matches get the role told by lookup
+func (o *Options) SetRoleLookup(lookup RoleLookup) {
+	o.admin.Lock()
+	defer o.admin.Unlock()
+	o.lookup = lookup
+}
+
+// client is what a rule can match in a request
+type client struct {
+	key         string // of the lease, see clientKey
+	mac         string
+	vendorClass string
+	userClass   []string
+	hostname    string
+	circuitId   string
+	remoteId    string
+	iface       string
+}
+
+func newClient(req *dhcpv4.DHCPv4, ifname string) *client {
+	c := &client{
+		mac:         req.ClientHWAddr.String(),
+		vendorClass: req.ClassIdentifier(),
+		userClass:   req.UserClass(),
+		hostname:    req.HostName(),
+		iface:       ifname,
+	}
+	c.key, _ = clientKey(req)
+	if rai := req.RelayAgentInfo(); rai != nil {
+		c.circuitId = string(rai.Get(dhcpv4.AgentCircuitIDSubOption))
+		c.remoteId = string(rai.Get(dhcpv4.AgentRemoteIDSubOption))
+	}
+	return c
+}
+
+// rule is a configured rule with the index of its role
+type rule struct {
+	base.Rule
+	role int
+}
+
+// setupRules checks the rules and sorts them by priority, the file order is kept for equal ones
+func (o *Options) setupRules(rules []base.Rule) error {
+	o.rules = nil
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		idx, ok := o.findRole(r.Role)
+		if !ok {
+			return fmt.Errorf("rule %s has the unknown role %s", r.Name, r.Role)
+		}
+		o.rules = append(o.rules, &rule{Rule: r, role: idx})
+	}
+	sort.SliceStable(o.rules, func(i, j int) bool { return o.rules[i].Priority > o.rules[j].Priority })
+	return nil
+}
+
+// match reports whether all the fields set in the rule match c
+func (r *rule) match(c *client) bool {
+	if r.Mac != "" && !strings.HasPrefix(c.mac, strings.ToLower(r.Mac)) {
+		return false
+	}
+	if r.UserClass != "" {
+		found := false
+		for _, uc := range c.userClass {
+			if matchPattern(r.UserClass, uc) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, f := range []struct{ pattern, value string }{
+		{r.VendorClass, c.vendorClass},
+		{r.Hostname, c.hostname},
+		{r.CircuitId, c.circuitId},
+		{r.RemoteId, c.remoteId},
+		{r.Iface, c.iface},
+	} {
+		if f.pattern != "" && !matchPattern(f.pattern, f.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPattern compares case-insensitively, a trailing "*" matches any suffix
+func matchPattern(pattern, s string) bool {
+	pattern, s = strings.ToLower(pattern), strings.ToLower(s)
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(s, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == s
+}
+
+// findSubnetIndex returns the role of the client of req: the role of its reservation, of
+// its lease, set by SetRole, of the first matching rule, told by the center, or the
+// fallback role, in this order. A relayed client only gets a role on the network of its
+// relay, -1 if there is none, a local one a role served on ifname.
+func (o *Options) findSubnetIndex(req *dhcpv4.DHCPv4, ifname string) int {
+	c := newClient(req, ifname)
+	idx, reason := o.classify(req, c)
+	link := relayLink(req)
+	if link == nil {
+		if served, ok := o.ifaceRole(ifname, idx); !ok {
+			idx, reason = served, fmt.Sprintf("interface %s, %s is role %s", ifname, reason, o.roles[idx].name)
+		}
+	}
+	if link != nil && !o.roles[idx].subnetContains(link) {
+		onLink := o.findSubnetIndexByIP(link)
+		if onLink < 0 {
+			log.Warningf("MAC %s relayed from %s, no role on that network, ignoring", c.mac, link)
+			return -1
+		}
+		idx, reason = onLink, fmt.Sprintf("relayed from %s, %s is role %s", link, reason, o.roles[idx].name)
+	}
+	log.Infof("MAC %s is role %s: %s", c.mac, o.roles[idx].name, reason)
+	return idx
+}
+
+func (o *Options) classify(req *dhcpv4.DHCPv4, c *client) (int, string) {
+	unlock := o.lockClient(c.key)
+	if h := o.findHost(req); h != nil {
+		defer unlock()
+		return h.role, "reservation " + h.ip.String()
+	}
+	record, ok := o.records.get(c.key)
+	lookup := o.lookup
+	assigned, isAssigned := o.assigned[c.mac]
+	if ok && record.held() && (record.state != leaseOffered || req.MessageType() != dhcpv4.MessageTypeDiscover) {
+		// the lease keeps its role, only a new DISCOVER is classified again
+		defer unlock()
+		return o.roleIndex(record.role), "lease " + record.state.String()
+	}
+	unlock()
+
+	if isAssigned {
+		if idx, ok := o.findRole(assigned); ok {
+			return idx, "assigned"
+		}
+	}
+	for _, r := range o.rules {
+		if r.match(c) {
+			return r.role, "rule " + r.Name
+		}
+	}
+	if lookup != nil {
+		if name := lookup(c.mac); name != "" {
+			if idx, ok := o.findRole(name); ok {
+				return idx, "control center"
+			}
+			log.Warningf("Control center gave MAC %s the unknown role %s", c.mac, name)
+		}
+	}
+	return o.fallback, "fallback"
+}
@@ -0,0 +1,128 @@
+package options
+
+import (
+	"errors"
+	"sync"
+
+	"minidhcp/options/leasestore"
+)
+
+// the most lease changes written with one sync
+const maxBatch = 256
+
+// commit is a lease change waiting for its batch to be written
+type commit struct {
+	change leasestore.Change
+	err    error
+	done   chan struct{}
+}
+
+// errCommitterClosed fails the changes queued once the committer is closed
+var errCommitterClosed = errors.New("lease store closed")
+
+// key returns the client of the change
+func (cm *commit) key() string {
+	if cm.change.Lease != nil {
+		return cm.change.Lease.Key()
+	}
+	return cm.change.Key
+}
+
+// fail ends cm with err
+func (cm *commit) fail(err error) {
+	log.Errorf("Could not persist lease of client %s: %v", cm.key(), err)
+	cm.err = err
+	close(cm.done)
+}
+
+// wait returns once the change is durable, or failed
+func (c *commit) wait() error {
+	<-c.done
+	return c.err
+}
+
+// committer writes the lease changes of all the requests to the store in batches. The
+// changes queued while a batch is synced go in the next one, so concurrent requests
+// share the sync instead of waiting for each other's.
+type committer struct {
+	store   leasestore.LeaseStore
+	changes chan *commit
+	stopped chan struct{}
+	mu      sync.RWMutex // read locked to queue, write locked to close changes
+	closed  bool
+}
+
+func newCommitter(store leasestore.LeaseStore) *committer {
+	c := &committer{store: store, changes: make(chan *commit, maxBatch), stopped: make(chan struct{})}
+	go c.run()
+	return c
+}
+
+// put queues l to be written
+func (c *committer) put(l *leasestore.Lease) *commit {
+	return c.queue(leasestore.Change{Lease: l})
+}
+
+// delete queues the removal of the lease of key
+func (c *committer) delete(key string) *commit {
+	return c.queue(leasestore.Change{Key: key})
+}
+
+// queue sends change to run, the commit has failed already if the committer is closed
+func (c *committer) queue(change leasestore.Change) *commit {
+	cm := &commit{change: change, done: make(chan struct{})}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		cm.fail(errCommitterClosed)
+		return cm
+	}
+	c.changes <- cm
+	return cm
+}
+
+func (c *committer) run() {
+	defer close(c.stopped)
+	for cm := range c.changes {
+		batch := []*commit{cm}
+	fill:
+		for len(batch) < maxBatch {
+			select {
+			case cm, ok := <-c.changes:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, cm)
+			default:
+				break fill
+			}
+		}
+		c.write(batch)
+	}
+}
+
+func (c *committer) write(batch []*commit) {
+	changes := make([]leasestore.Change, len(batch))
+	for i, cm := range batch {
+		changes[i] = cm.change
+	}
+	err := leasestore.Write(c.store, changes)
+	for _, cm := range batch {
+		if err != nil {
+			cm.fail(err)
+			continue
+		}
+		close(cm.done)
+	}
+}
+
+// close writes the queued changes and stops, the changes queued after fail
+func (c *committer) close() {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.changes)
+	}
+	c.mu.Unlock()
+	<-c.stopped
+}
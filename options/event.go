@@ -0,0 +1,43 @@
+package options
+
+import (
+	"net"
+	"time"
+)
+
+// EventType tells what happened to a lease
+type EventType string
+
+const (
+	EventLeaseExpired   EventType = "lease-expired"   // lease time is over, the grace period starts
+	EventLeaseReclaimed EventType = "lease-reclaimed" // grace period is over, IP is back in the allocator
+	EventRoleChanged    EventType = "role-changed"    // MAC was moved to Role, IP is the freed one if any
+	EventForceRenew     EventType = "force-renew"     // the client at IP has to be sent a DHCPFORCERENEW
+	EventPoolDrain      EventType = "pool-drain"      // Role leases new IPs faster than its limit, MAC was refused
+)
+
+// Event is sent to the subscribers of Options when a lease changes
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Mac      string
+	ClientId string // hex, "" if the client sent none
+	IP       net.IP
+	Role     string
+}
+
+// Subscribe registers fn to get every Event, fn is called on the packet path and by the
+// reaper, with Options locked, and must not block
+func (o *Options) Subscribe(fn func(Event)) {
+	o.admin.Lock()
+	defer o.admin.Unlock()
+	o.subscribers = append(o.subscribers, fn)
+}
+
+func (o *Options) emit(typ EventType, rec *Record) {
+	ev := Event{Type: typ, Time: time.Now(), Mac: rec.mac, ClientId: rec.clientId, IP: rec.IP, Role: rec.role}
+	log.Infof("%s: IP %s MAC %s role %s", ev.Type, ev.IP, ev.Mac, ev.Role)
+	for _, fn := range o.subscribers {
+		fn(ev)
+	}
+}
@@ -0,0 +1,329 @@
+package options
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"minidhcp/base"
+	"minidhcp/options/leasestore"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// host is a fixed IP reserved to a client, it's never handed out by the pools
+type host struct {
+	base.Host
+	role      int
+	ip        net.IP
+	leaseTime time.Duration // 0 for the lease time of the role
+}
+
+// owns reports whether rec is the lease of the client of the reservation
+func (ht *host) owns(rec *Record) bool {
+	if ht.ClientId != "" {
+		return rec.clientId == ht.ClientId
+	}
+	return rec.mac == ht.Mac
+}
+
+// Reservation is a host reserved in a role
+type Reservation struct {
+	Role string
+	Host base.Host
+}
+
+// hostKey is the client-id if it's set, the MAC otherwise, as the key of the lease
+func hostKey(mac string, clientId []byte) string {
+	return leasestore.Key(mac, hex.EncodeToString(clientId))
+}
+
+// parseClientId parses hex bytes, optionally separated by ":"
+func parseClientId(s string) ([]byte, error) {
+	id, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(id) == 0 {
+		return nil, fmt.Errorf("malformed client-id: %s", s)
+	}
+	return id, nil
+}
+
+// newHost checks h against role r and normalizes its MAC and client-id
+func newHost(r *role, idx int, h base.Host) (*host, string, error) {
+	if h.Mac == "" && h.ClientId == "" {
+		return nil, "", errors.New("reservation needs a MAC or a client-id")
+	}
+	if h.Mac != "" {
+		hwaddr, err := net.ParseMAC(h.Mac)
+		if err != nil {
+			return nil, "", fmt.Errorf("malformed hardware address: %s", h.Mac)
+		}
+		h.Mac = hwaddr.String()
+	}
+	var clientId []byte
+	if h.ClientId != "" {
+		id, err := parseClientId(h.ClientId)
+		if err != nil {
+			return nil, "", err
+		}
+		clientId = id
+		h.ClientId = hex.EncodeToString(id)
+	}
+
+	ht := &host{Host: h, role: idx, ip: net.ParseIP(h.Ip).To4()}
+	if ht.ip == nil {
+		return nil, "", fmt.Errorf("expected an IPv4 address, got: %v", h.Ip)
+	}
+	if !r.subnetContains(ht.ip) {
+		return nil, "", fmt.Errorf("IP %s is not on the network of role %s", h.Ip, r.name)
+	}
+	for _, ip := range []string{h.Dns, h.Router} {
+		if ip != "" && net.ParseIP(ip).To4() == nil {
+			return nil, "", fmt.Errorf("expected an IPv4 address, got: %v", ip)
+		}
+	}
+	if h.LeaseTime != "" {
+		d, err := time.ParseDuration(h.LeaseTime)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid lease duration: %v", h.LeaseTime)
+		}
+		ht.leaseTime = d
+	}
+	return ht, hostKey(h.Mac, clientId), nil
+}
+
+// setupHosts adds the reservations of the roles in the config
+func (o *Options) setupHosts() error {
+	o.hosts = make(map[string]*host)
+	for idx, r := range o.roles {
+		for _, h := range r.subnet.Hosts {
+			if err := o.addHost(idx, h); err != nil {
+				return fmt.Errorf("role %s: %w", r.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// findHost returns the reservation of the client of req, nil if there is none
+func (o *Options) findHost(req *dhcpv4.DHCPv4) *host {
+	if id := req.Options.Get(dhcpv4.OptionClientIdentifier); len(id) != 0 {
+		if h, ok := o.hosts[hostKey("", id)]; ok {
+			return h
+		}
+	}
+	return o.hosts[req.ClientHWAddr.String()]
+}
+
+// recordHost returns the reservation of the client of rec, nil if there is none
+func (o *Options) recordHost(rec *Record) *host {
+	if rec.clientId != "" {
+		if h, ok := o.hosts[leasestore.Key("", rec.clientId)]; ok {
+			return h
+		}
+	}
+	return o.hosts[rec.mac]
+}
+
+// hostRecords returns the leases of the client of the reservation of key, the one
+// keyed by the reservation and the last one of its MAC
+func (o *Options) hostRecords(ht *host, key string) []*Record {
+	var recs []*Record
+	if rec, ok := o.records.get(key); ok {
+		recs = append(recs, rec)
+	}
+	if rec, ok := o.records.ofMac(ht.Mac); ok && ht.owns(rec) && rec.key() != key {
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// addHost reserves the IP of h, the current lease of the client is dropped if it's
+// another IP, so its next RENEW is NAKed
+func (o *Options) addHost(idx int, h base.Host) error {
+	r := o.roles[idx]
+	ht, key, err := newHost(r, idx, h)
+	if err != nil {
+		return err
+	}
+	if _, ok := o.hosts[key]; ok {
+		return fmt.Errorf("client %s already has a reservation", key)
+	}
+	for _, other := range o.hosts {
+		if other.ip.Equal(ht.ip) {
+			return fmt.Errorf("IP %s is already reserved", ht.ip)
+		}
+	}
+
+	// the client may be holding the IP already, anyone else is in the way
+	holder, ok := o.records.ofIP(ht.ip)
+	if ok && !holder.held() {
+		holder = nil
+	}
+	if holder != nil && !ht.owns(holder) {
+		return fmt.Errorf("IP %s is leased to client %s", ht.ip, holder.key())
+	}
+	if holder == nil && r.rangeContains(ht.ip) {
+		if err := r.reserve(ht.ip); err != nil {
+			return err
+		}
+	}
+	r.hosts[ht.ip.String()] = ht
+	o.hosts[key] = ht
+
+	for _, rec := range o.hostRecords(ht, key) {
+		if rec.held() && !rec.IP.Equal(ht.ip) {
+			if err := o.roles[o.roleIndex(rec.role)].free(rec.IP); err != nil {
+				log.Warningf("Free IP %s for client %s: %v", rec.IP, rec.key(), err)
+			}
+			o.dropRecord(rec.key())
+		}
+	}
+	log.Infof("Reserved IP %s to %s in role %s", ht.ip, key, r.name)
+	return nil
+}
+
+// removeHost gives the IP of the reservation back to the pool, unless it's leased
+func (o *Options) removeHost(key string) (*host, error) {
+	ht, ok := o.hosts[key]
+	if !ok {
+		return nil, fmt.Errorf("no reservation for %s", key)
+	}
+	r := o.roles[ht.role]
+	delete(o.hosts, key)
+	delete(r.hosts, ht.ip.String())
+
+	rec, leased := o.records.ofIP(ht.ip)
+	leased = leased && rec.held()
+	if !leased && r.rangeContains(ht.ip) {
+		if err := r.free(ht.ip); err != nil {
+			log.Warningf("Free reserved IP %s: %v", ht.ip, err)
+		}
+	}
+	log.Infof("Removed the reservation of IP %s to %s in role %s", ht.ip, key, r.name)
+	return ht, nil
+}
+
+// syncHosts writes the reservations of role idx back to the config
+func (o *Options) syncHosts(idx int) {
+	r := o.roles[idx]
+	hosts := []base.Host{}
+	for _, ht := range o.hosts {
+		if ht.role == idx {
+			hosts = append(hosts, ht.Host)
+		}
+	}
+	r.subnet.Hosts = hosts
+	if sub := o.conf.FindRole(r.name); sub != nil {
+		sub.Hosts = hosts
+	}
+}
+
+// hostKeyOf returns the key of the reservation of mac or clientId
+func hostKeyOf(mac, clientId string) (string, error) {
+	if clientId != "" {
+		id, err := parseClientId(clientId)
+		if err != nil {
+			return "", err
+		}
+		return hostKey("", id), nil
+	}
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", fmt.Errorf("malformed hardware address: %s", mac)
+	}
+	return hwaddr.String(), nil
+}
+
+// Reservations returns the reserved hosts of all roles
+func (o *Options) Reservations() []Reservation {
+	o.admin.RLock()
+	defer o.admin.RUnlock()
+	res := make([]Reservation, 0, len(o.hosts))
+	for _, ht := range o.hosts {
+		res = append(res, Reservation{Role: o.roles[ht.role].name, Host: ht.Host})
+	}
+	return res
+}
+
+// SaveConfig writes the config with the reservations back to its file
+func (o *Options) SaveConfig() error {
+	o.admin.RLock()
+	defer o.admin.RUnlock()
+	return o.conf.Marshal()
+}
+
+// AddReservation reserves h.Ip to the client of h in role, "" for the role whose
+// network holds h.Ip
+func (o *Options) AddReservation(role string, h base.Host) error {
+	o.admin.Lock()
+	defer o.admin.Unlock()
+	idx, err := o.reservationRole(role, h.Ip)
+	if err != nil {
+		return err
+	}
+	if err = o.addHost(idx, h); err != nil {
+		return err
+	}
+	o.syncHosts(idx)
+	return nil
+}
+
+// UpdateReservation replaces the reservation of the client of h
+func (o *Options) UpdateReservation(role string, h base.Host) error {
+	o.admin.Lock()
+	defer o.admin.Unlock()
+	key, err := hostKeyOf(h.Mac, h.ClientId)
+	if err != nil {
+		return err
+	}
+	idx, err := o.reservationRole(role, h.Ip)
+	if err != nil {
+		return err
+	}
+	old, err := o.removeHost(key)
+	if err != nil {
+		return err
+	}
+	if err = o.addHost(idx, h); err != nil {
+		// put the old one back, its IP was just given back so it can't fail
+		o.addHost(old.role, old.Host)
+		return err
+	}
+	o.syncHosts(old.role)
+	o.syncHosts(idx)
+	return nil
+}
+
+// DeleteReservation removes the reservation of mac or clientId
+func (o *Options) DeleteReservation(mac, clientId string) error {
+	o.admin.Lock()
+	defer o.admin.Unlock()
+	key, err := hostKeyOf(mac, clientId)
+	if err != nil {
+		return err
+	}
+	ht, err := o.removeHost(key)
+	if err != nil {
+		return err
+	}
+	o.syncHosts(ht.role)
+	return nil
+}
+
+func (o *Options) reservationRole(role, ip string) (int, error) {
+	if role != "" {
+		idx, ok := o.findRole(role)
+		if !ok {
+			return 0, fmt.Errorf("unknown role: %s", role)
+		}
+		return idx, nil
+	}
+	idx := o.findSubnetIndexByIP(net.ParseIP(ip))
+	if idx < 0 {
+		return 0, fmt.Errorf("IP %s is not on the network of any role", ip)
+	}
+	return idx, nil
+}
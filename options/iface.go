@@ -0,0 +1,81 @@
+package options
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// iface is an interface the server listens on
+type iface struct {
+	name     string
+	roles    []int // of its local clients, all roles if empty
+	serverId net.IP
+}
+
+// setupIfaces binds the configured interfaces to their roles
+func (o *Options) setupIfaces() error {
+	o.ifaces = make(map[string]*iface)
+	for _, ifc := range o.conf.Ifaces() {
+		if _, ok := o.ifaces[ifc.Name]; ok {
+			return fmt.Errorf("interface %s configured twice", ifc.Name)
+		}
+		srvid := net.ParseIP(ifc.ServerId).To4()
+		if srvid == nil && ifc.ServerId != "" {
+			return fmt.Errorf("interface %s has the malformed serverid %s", ifc.Name, ifc.ServerId)
+		}
+		i := &iface{name: ifc.Name, serverId: srvid}
+		for _, name := range ifc.Roles {
+			idx, ok := o.findRole(name)
+			if !ok {
+				return fmt.Errorf("interface %s has the unknown role %s", ifc.Name, name)
+			}
+			i.roles = append(i.roles, idx)
+		}
+		o.ifaces[ifc.Name] = i
+	}
+	return nil
+}
+
+// serverId returns the server identifier on the interface ifname
+func (o *Options) serverId(ifname string) net.IP {
+	if i, ok := o.ifaces[ifname]; ok && i.serverId != nil {
+		return i.serverId
+	}
+	return net.ParseIP(o.conf.ServerId).To4()
+}
+
+// onLink reports whether ip is on a network served for the link of req: the networks
+// of the roles holding the relay link, or of the roles of the interface ifname
+func (o *Options) onLink(req *dhcpv4.DHCPv4, ifname string, ip net.IP) bool {
+	link := relayLink(req)
+	for idx, r := range o.roles {
+		if link != nil && !r.subnetContains(link) {
+			continue
+		}
+		if link == nil {
+			if _, ok := o.ifaceRole(ifname, idx); !ok {
+				continue
+			}
+		}
+		if r.subnetContains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ifaceRole returns idx if the interface ifname serves the role, its first role otherwise
+func (o *Options) ifaceRole(ifname string, idx int) (int, bool) {
+	i, ok := o.ifaces[ifname]
+	if !ok || len(i.roles) == 0 {
+		return idx, true
+	}
+	for _, r := range i.roles {
+		if r == idx {
+			return idx, true
+		}
+	}
+	return i.roles[0], false
+}
@@ -0,0 +1,148 @@
+package options
+
+import (
+	"net"
+	"sync"
+)
+
+// how many shards the lease index and the client locks are split in
+const shards = 64
+
+// shardOf hashes key to a shard, FNV-1a
+func shardOf(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % shards)
+}
+
+// recordMap is a map of records split in shards, each with its own lock
+type recordMap [shards]struct {
+	sync.RWMutex
+	m map[string]*Record
+}
+
+func newRecordMap() *recordMap {
+	m := new(recordMap)
+	for i := range m {
+		m[i].m = make(map[string]*Record)
+	}
+	return m
+}
+
+func (m *recordMap) get(key string) (*Record, bool) {
+	s := &m[shardOf(key)]
+	s.RLock()
+	defer s.RUnlock()
+	rec, ok := s.m[key]
+	return rec, ok
+}
+
+func (m *recordMap) set(key string, rec *Record) {
+	s := &m[shardOf(key)]
+	s.Lock()
+	defer s.Unlock()
+	s.m[key] = rec
+}
+
+// remove deletes key if it's still rec, nil deletes whatever it is
+func (m *recordMap) remove(key string, rec *Record) *Record {
+	s := &m[shardOf(key)]
+	s.Lock()
+	defer s.Unlock()
+	old, ok := s.m[key]
+	if !ok || (rec != nil && old != rec) {
+		return nil
+	}
+	delete(s.m, key)
+	return old
+}
+
+// leaseIndex finds the records by key, by MAC and by IP, it's safe for concurrent use.
+// The records themselves are only read and changed under the lock of their client, see
+// Options.lockClient, the MAC and IP entries are of the last record added with them.
+type leaseIndex struct {
+	byKey *recordMap
+	byMac *recordMap
+	byIP  *recordMap
+}
+
+func newLeaseIndex() *leaseIndex {
+	return &leaseIndex{byKey: newRecordMap(), byMac: newRecordMap(), byIP: newRecordMap()}
+}
+
+// get returns the record of the client key
+func (x *leaseIndex) get(key string) (*Record, bool) {
+	return x.byKey.get(key)
+}
+
+// add indexes rec, it replaces the record of its client
+func (x *leaseIndex) add(rec *Record) {
+	if old, ok := x.byKey.get(rec.key()); ok && old != rec {
+		x.unlink(old)
+	}
+	x.byKey.set(rec.key(), rec)
+	x.byMac.set(rec.mac, rec)
+	x.byIP.set(rec.IP.String(), rec)
+}
+
+// remove forgets the record of the client key, it returns nil if there was none
+func (x *leaseIndex) remove(key string) *Record {
+	rec := x.byKey.remove(key, nil)
+	if rec != nil {
+		x.unlink(rec)
+	}
+	return rec
+}
+
+func (x *leaseIndex) unlink(rec *Record) {
+	x.byMac.remove(rec.mac, rec)
+	x.byIP.remove(rec.IP.String(), rec)
+}
+
+// moveMac indexes rec by its MAC, which was old
+func (x *leaseIndex) moveMac(rec *Record, old string) {
+	if old == rec.mac {
+		return
+	}
+	x.byMac.remove(old, rec)
+	x.byMac.set(rec.mac, rec)
+}
+
+// ofMac returns the record of the last request with chaddr mac
+func (x *leaseIndex) ofMac(mac string) (*Record, bool) {
+	return x.byMac.get(mac)
+}
+
+// ofIP returns the last record on ip, the caller checks whether it's still held
+func (x *leaseIndex) ofIP(ip net.IP) (*Record, bool) {
+	return x.byIP.get(ip.String())
+}
+
+// keys returns the keys of all the records
+func (x *leaseIndex) keys() []string {
+	var keys []string
+	for i := range x.byKey {
+		s := &x.byKey[i]
+		s.RLock()
+		for key := range s.m {
+			keys = append(keys, key)
+		}
+		s.RUnlock()
+	}
+	return keys
+}
+
+// len returns the number of records
+func (x *leaseIndex) len() int {
+	n := 0
+	for i := range x.byKey {
+		s := &x.byKey[i]
+		s.RLock()
+		n += len(s.m)
+		s.RUnlock()
+	}
+	return n
+}
@@ -0,0 +1,118 @@
+package options
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	"minidhcp/options/leasestore"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// leaseState is where a Record is in its life, see leaseTransitions for the allowed moves
+type leaseState int
+
+const (
+	leaseOffered   leaseState = iota // DISCOVER answered, IP held in memory for a short time
+	leaseBound                       // REQUEST acked, the only state persisted as a lease
+	leaseReleased                    // client sent DHCPRELEASE, IP is back in the allocator
+	leaseExpired                     // lease time is over, IP held for the client until the grace period ends
+	leaseDeclined                    // client sent DHCPDECLINE, IP is in quarantine
+	leaseAbandoned                   // IP is used by someone else, not by the client
+)
+
+var leaseStateNames = []string{"offered", "bound", "released", "expired", "declined", "abandoned"}
+
+func (s leaseState) String() string {
+	if int(s) < len(leaseStateNames) {
+		return leaseStateNames[s]
+	}
+	return fmt.Sprintf("leaseState(%d)", int(s))
+}
+
+// leaseTransitions holds the states a lease can move to from each state
+var leaseTransitions = map[leaseState][]leaseState{
+	leaseOffered:   {leaseOffered, leaseBound, leaseExpired, leaseDeclined, leaseAbandoned},
+	leaseBound:     {leaseBound, leaseReleased, leaseExpired, leaseDeclined, leaseAbandoned},
+	leaseReleased:  {leaseOffered},
+	leaseExpired:   {leaseOffered, leaseBound},
+	leaseDeclined:  {leaseOffered},
+	leaseAbandoned: {leaseOffered},
+}
+
+//Record holds an IP lease record
+type Record struct {
+	IP       net.IP
+	mac      string // chaddr of the last request
+	clientId string // hex, "" if the client sent none
+	expires  time.Time
+	role     string
+	state    leaseState
+	probe    bool                 // the IP is new, it's probed before it's offered
+	xid      dhcpv4.TransactionID // of the request the record was created for
+}
+
+// key is the key of the record in the lease index and in the lease store
+func (r *Record) key() string {
+	return leasestore.Key(r.mac, r.clientId)
+}
+
+// clientKey returns the key of the lease of the client of req, the client-id (option 61)
+// if it sent one, chaddr otherwise, as RFC 2131 4.2 recommends
+func clientKey(req *dhcpv4.DHCPv4) (key, clientId string) {
+	if id := req.Options.Get(dhcpv4.OptionClientIdentifier); len(id) != 0 {
+		clientId = hex.EncodeToString(id)
+	}
+	return leasestore.Key(req.ClientHWAddr.String(), clientId), clientId
+}
+
+// setState moves the record to state s, if the state machine allows it
+func (r *Record) setState(s leaseState) error {
+	for _, next := range leaseTransitions[r.state] {
+		if next == s {
+			r.state = s
+			return nil
+		}
+	}
+	return fmt.Errorf("lease %s: invalid transition %v -> %v", r.IP, r.state, s)
+}
+
+// lease converts the record to the stored lease
+func (r *Record) lease() *leasestore.Lease {
+	return &leasestore.Lease{
+		Mac:      r.mac,
+		ClientId: r.clientId,
+		IP:       r.IP,
+		Expires:  r.expires,
+		Role:     r.role,
+		State:    r.state.String(),
+	}
+}
+
+func recordFromLease(l *leasestore.Lease) (*Record, error) {
+	for s, name := range leaseStateNames {
+		if name == l.State {
+			return &Record{
+				IP:       l.IP.To4(),
+				mac:      l.Mac,
+				clientId: l.ClientId,
+				expires:  l.Expires,
+				role:     l.Role,
+				state:    leaseState(s),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown lease state: %s", l.State)
+}
+
+// active reports whether the client may use the IP of the record
+func (r *Record) active() bool {
+	return r.state == leaseOffered || r.state == leaseBound
+}
+
+// held reports whether the record holds its IP in the allocator for the client
+func (r *Record) held() bool {
+	return r.active() || r.state == leaseExpired
+}
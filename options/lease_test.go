@@ -0,0 +1,44 @@
+package options
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLeaseTransitions(t *testing.T) {
+	rec := &Record{IP: net.IPv4(192, 0, 2, 1), state: leaseOffered}
+
+	steps := []struct {
+		to leaseState
+		ok bool
+	}{
+		{leaseBound, true},
+		{leaseBound, true},
+		{leaseOffered, false},
+		{leaseReleased, true},
+		{leaseBound, false},
+		{leaseOffered, true},
+		{leaseDeclined, true},
+		{leaseBound, false},
+	}
+	for _, s := range steps {
+		from := rec.state
+		err := rec.setState(s.to)
+		if s.ok && err != nil {
+			t.Fatalf("%v -> %v: %v", from, s.to, err)
+		}
+		if !s.ok && err == nil {
+			t.Fatalf("%v -> %v: expected invalid transition", from, s.to)
+		}
+	}
+}
+
+func TestLeaseActive(t *testing.T) {
+	for s := leaseOffered; s <= leaseAbandoned; s++ {
+		rec := &Record{state: s}
+		want := s == leaseOffered || s == leaseBound
+		if rec.active() != want {
+			t.Errorf("%v: active %v, want %v", s, rec.active(), want)
+		}
+	}
+}
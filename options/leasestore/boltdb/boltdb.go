@@ -0,0 +1,125 @@
+// Package boltdb stores the leases in an embedded bbolt database
+package boltdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"minidhcp/options/leasestore"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucketLeases = []byte("leases")
+
+// Store keeps the leases in one bucket, lease key -> json encoded lease
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens or creates the database at path
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lease db %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketLeases)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create bucket in %s: %w", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Get returns the lease of key
+func (s *Store) Get(key string) (*leasestore.Lease, error) {
+	var l *leasestore.Lease
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketLeases).Get([]byte(key))
+		if v == nil {
+			return leasestore.ErrNotFound
+		}
+		l = new(leasestore.Lease)
+		return json.Unmarshal(v, l)
+	})
+	return l, err
+}
+
+// Put writes the lease in its own transaction, bbolt syncs on commit
+func (s *Store) Put(l *leasestore.Lease) error {
+	v, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLeases).Put([]byte(l.Key()), v)
+	})
+}
+
+// Delete removes the lease of key
+func (s *Store) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLeases).Delete([]byte(key))
+	})
+}
+
+// Write applies the changes in one transaction, so they share the sync of its commit
+func (s *Store) Write(changes []leasestore.Change) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketLeases)
+		for _, c := range changes {
+			if c.Lease == nil {
+				if err := b.Delete([]byte(c.Key)); err != nil {
+					return err
+				}
+				continue
+			}
+			v, err := json.Marshal(c.Lease)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(c.Lease.Key()), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Iterate calls fn for every lease in key order, inside a read transaction
+func (s *Store) Iterate(fn func(*leasestore.Lease) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLeases).ForEach(func(k, v []byte) error {
+			l := new(leasestore.Lease)
+			if err := json.Unmarshal(v, l); err != nil {
+				return fmt.Errorf("malformed lease of %s: %v", k, err)
+			}
+			return fn(l)
+		})
+	})
+}
+
+// FindByIP returns the leases holding ip
+func (s *Store) FindByIP(ip net.IP) ([]*leasestore.Lease, error) {
+	return leasestore.Find(s, func(l *leasestore.Lease) bool { return l.IP.Equal(ip) })
+}
+
+// FindByMac returns the leases of mac
+func (s *Store) FindByMac(mac net.HardwareAddr) ([]*leasestore.Lease, error) {
+	return leasestore.Find(s, func(l *leasestore.Lease) bool { return l.Mac == mac.String() })
+}
+
+// FindByRole returns the leases of the role
+func (s *Store) FindByRole(role string) ([]*leasestore.Lease, error) {
+	return leasestore.Find(s, func(l *leasestore.Lease) bool { return l.Role == role })
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
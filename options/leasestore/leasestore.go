@@ -0,0 +1,101 @@
+// Package leasestore provides the interface to the storage of the DHCPv4 leases,
+// the implementations live in the sub packages.
+package leasestore
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Lease is a stored lease of a client, keyed by its client identifier if it sent one,
+// by its MAC otherwise
+type Lease struct {
+	Mac      string
+	ClientId string // option 61 in hex, "" if the client didn't send one
+	IP       net.IP
+	Expires  time.Time
+	Role     string
+	State    string
+}
+
+// Key returns the key of the lease, "id:" and the client-id, or the MAC
+func (l *Lease) Key() string {
+	return Key(l.Mac, l.ClientId)
+}
+
+// Key returns the key of the lease of mac and clientId, clientId in hex
+func Key(mac, clientId string) string {
+	if clientId != "" {
+		return "id:" + clientId
+	}
+	return mac
+}
+
+// LeaseStore is the interface to the lease storage. It only keeps the last lease of
+// each key and is not concerned with the lease life, the caller decides what to put.
+type LeaseStore interface {
+	// Get returns the lease of key, or ErrNotFound
+	Get(key string) (*Lease, error)
+	// Put adds or replaces the lease of l.Key(), it is durable once Put returns
+	Put(l *Lease) error
+	// Delete removes the lease of key, it's not an error if there is none
+	Delete(key string) error
+	// Iterate calls fn for every lease until fn returns an error
+	Iterate(fn func(*Lease) error) error
+	// FindByIP returns the leases holding ip, there can be more than one from old records
+	FindByIP(ip net.IP) ([]*Lease, error)
+	// FindByMac returns the leases of mac, one per client-id the MAC was seen with
+	FindByMac(mac net.HardwareAddr) ([]*Lease, error)
+	// FindByRole returns the leases of the role
+	FindByRole(role string) ([]*Lease, error)
+	// Close flushes and closes the storage
+	Close() error
+}
+
+// Change is a Put of Lease, or a Delete of Key when Lease is nil
+type Change struct {
+	Lease *Lease
+	Key   string
+}
+
+// Batcher is a LeaseStore that writes many changes at the cost of one, the changes
+// are applied in order and are durable once Write returns
+type Batcher interface {
+	Write(changes []Change) error
+}
+
+// Write applies the changes to s, in one batch if s is a Batcher, one by one otherwise
+func Write(s LeaseStore, changes []Change) error {
+	if b, ok := s.(Batcher); ok {
+		return b.Write(changes)
+	}
+	for _, c := range changes {
+		var err error
+		if c.Lease != nil {
+			err = s.Put(c.Lease)
+		} else {
+			err = s.Delete(c.Key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrNotFound is returned by Get when there is no lease for the key
+var ErrNotFound = errors.New("lease not found")
+
+// Find returns the leases matched by match, for stores without an index
+func Find(s LeaseStore, match func(*Lease) bool) ([]*Lease, error) {
+	var leases []*Lease
+	err := s.Iterate(func(l *Lease) error {
+		if match(l) {
+			c := *l
+			leases = append(leases, &c)
+		}
+		return nil
+	})
+	return leases, err
+}
@@ -0,0 +1,155 @@
+package leasestore_test
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"minidhcp/options/leasestore"
+	"minidhcp/options/leasestore/boltdb"
+	"minidhcp/options/leasestore/sqlite"
+	"minidhcp/options/leasestore/textfile"
+)
+
+var stores = []struct {
+	name string
+	open func(path string) (leasestore.LeaseStore, error)
+}{
+	{"file", func(path string) (leasestore.LeaseStore, error) { return textfile.Open(path) }},
+	{"bolt", func(path string) (leasestore.LeaseStore, error) { return boltdb.Open(path) }},
+	{"sqlite", func(path string) (leasestore.LeaseStore, error) { return sqlite.Open(path) }},
+}
+
+func getLease(mac string, ip net.IP, role string) *leasestore.Lease {
+	return &leasestore.Lease{Mac: mac, IP: ip.To4(), Expires: time.Unix(1659507755, 0), Role: role, State: "bound"}
+}
+
+func TestLeaseStore(t *testing.T) {
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "lease")
+			s, err := st.open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := s.Get("00:00:00:00:00:01"); !errors.Is(err, leasestore.ErrNotFound) {
+				t.Fatalf("Get of unknown MAC: %v", err)
+			}
+			leases := []*leasestore.Lease{
+				getLease("00:00:00:00:00:01", net.IPv4(10, 10, 10, 100), "staff"),
+				getLease("00:00:00:00:00:02", net.IPv4(10, 10, 10, 101), "staff"),
+				getLease("00:00:00:00:00:03", net.IPv4(192, 168, 3, 1), "guest"),
+				// same MAC, other client-id: another lease
+				getLease("00:00:00:00:00:01", net.IPv4(10, 10, 10, 102), "staff"),
+			}
+			leases[3].ClientId = "ff00000001"
+			for _, l := range leases {
+				if err := s.Put(l); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// replace
+			leases[1].State = "released"
+			if err := s.Put(leases[1]); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("00:00:00:00:00:03"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("00:00:00:00:00:04"); err != nil {
+				t.Fatalf("Delete of unknown MAC: %v", err)
+			}
+
+			// everything survives a reopen
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			s, err = st.open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			l, err := s.Get("00:00:00:00:00:02")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.State != "released" || l.ClientId != "" || !l.IP.Equal(leases[1].IP) || !l.Expires.Equal(leases[1].Expires) || l.Role != "staff" {
+				t.Fatalf("Get: %+v", l)
+			}
+
+			l, err = s.Get("id:ff00000001")
+			if err != nil || !l.IP.Equal(leases[3].IP) || l.Mac != "00:00:00:00:00:01" {
+				t.Fatalf("Get by client-id: %+v %v", l, err)
+			}
+
+			n := 0
+			s.Iterate(func(*leasestore.Lease) error {
+				n++
+				return nil
+			})
+			if n != 3 {
+				t.Fatalf("Iterate: %d leases, want 3", n)
+			}
+
+			found, err := s.FindByIP(net.IPv4(10, 10, 10, 100))
+			if err != nil || len(found) != 1 || found[0].Mac != "00:00:00:00:00:01" {
+				t.Fatalf("FindByIP: %v %v", found, err)
+			}
+			mac, _ := net.ParseMAC("00:00:00:00:00:01")
+			found, err = s.FindByMac(mac)
+			if err != nil || len(found) != 2 || found[0].Mac != "00:00:00:00:00:01" || found[1].Mac != "00:00:00:00:00:01" {
+				t.Fatalf("FindByMac: %v %v", found, err)
+			}
+			mac, _ = net.ParseMAC("00:00:00:00:00:03")
+			if found, err = s.FindByMac(mac); err != nil || len(found) != 0 {
+				t.Fatalf("FindByMac of a deleted lease: %v %v", found, err)
+			}
+			found, err = s.FindByRole("staff")
+			if err != nil || len(found) != 3 {
+				t.Fatalf("FindByRole staff: %v %v", found, err)
+			}
+			found, err = s.FindByRole("guest")
+			if err != nil || len(found) != 0 {
+				t.Fatalf("FindByRole guest: %v %v", found, err)
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			s, err := st.open(filepath.Join(t.TempDir(), "lease"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if _, ok := s.(leasestore.Batcher); !ok {
+				t.Fatalf("%T is not a Batcher", s)
+			}
+
+			l1 := getLease("00:00:00:00:00:01", net.IPv4(10, 10, 10, 100), "staff")
+			l2 := getLease("00:00:00:00:00:02", net.IPv4(10, 10, 10, 101), "staff")
+			err = leasestore.Write(s, []leasestore.Change{
+				{Lease: l1},
+				{Lease: l2},
+				{Key: l1.Key()},
+				{Key: "00:00:00:00:00:03"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Get(l1.Key()); !errors.Is(err, leasestore.ErrNotFound) {
+				t.Fatalf("Get of a lease deleted in the batch: %v", err)
+			}
+			if l, err := s.Get(l2.Key()); err != nil || !l.IP.Equal(l2.IP) {
+				t.Fatalf("Get: %+v %v", l, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+// Package sqlite stores the leases in a SQLite database
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"minidhcp/options/leasestore"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS leases (
+	key       TEXT PRIMARY KEY,
+	mac       TEXT NOT NULL,
+	client_id TEXT NOT NULL,
+	ip        TEXT NOT NULL,
+	expires   INTEGER NOT NULL,
+	role      TEXT NOT NULL,
+	state     TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS leases_ip ON leases(ip);
+CREATE INDEX IF NOT EXISTS leases_mac ON leases(mac);
+CREATE INDEX IF NOT EXISTS leases_role ON leases(role);
+`
+
+const columns = "mac, client_id, ip, expires, role, state"
+
+const upsert = "INSERT OR REPLACE INTO leases (key, " + columns + ") VALUES (?, ?, ?, ?, ?, ?, ?)"
+
+// upsertArgs returns the values of l for upsert
+func upsertArgs(l *leasestore.Lease) []interface{} {
+	return []interface{}{l.Key(), l.Mac, l.ClientId, l.IP.String(), l.Expires.Unix(), l.Role, l.State}
+}
+
+// Store keeps the leases in the leases table
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens or creates the database at path
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_synchronous=FULL&_busy_timeout=1000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lease db %s: %w", path, err)
+	}
+	// sqlite has one writer, don't let the pool queue up on its lock
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema in %s: %w", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanLease(row scanner) (*leasestore.Lease, error) {
+	var (
+		l       leasestore.Lease
+		ip      string
+		expires int64
+	)
+	if err := row.Scan(&l.Mac, &l.ClientId, &ip, &expires, &l.Role, &l.State); err != nil {
+		return nil, err
+	}
+	l.IP = net.ParseIP(ip).To4()
+	l.Expires = time.Unix(expires, 0)
+	return &l, nil
+}
+
+func (s *Store) query(where string, args ...interface{}) ([]*leasestore.Lease, error) {
+	rows, err := s.db.Query("SELECT "+columns+" FROM leases "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var leases []*leasestore.Lease
+	for rows.Next() {
+		l, err := scanLease(rows)
+		if err != nil {
+			return nil, err
+		}
+		leases = append(leases, l)
+	}
+	return leases, rows.Err()
+}
+
+// Get returns the lease of key
+func (s *Store) Get(key string) (*leasestore.Lease, error) {
+	row := s.db.QueryRow("SELECT "+columns+" FROM leases WHERE key = ?", key)
+	l, err := scanLease(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, leasestore.ErrNotFound
+	}
+	return l, err
+}
+
+// Put inserts or replaces the lease of l.Key()
+func (s *Store) Put(l *leasestore.Lease) error {
+	_, err := s.db.Exec(upsert, upsertArgs(l)...)
+	return err
+}
+
+// Delete removes the lease of key
+func (s *Store) Delete(key string) error {
+	_, err := s.db.Exec("DELETE FROM leases WHERE key = ?", key)
+	return err
+}
+
+// Write applies the changes in one transaction, so they share the sync of its commit
+func (s *Store) Write(changes []leasestore.Change) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if c.Lease == nil {
+			_, err = tx.Exec("DELETE FROM leases WHERE key = ?", c.Key)
+		} else {
+			_, err = tx.Exec(upsert, upsertArgs(c.Lease)...)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Iterate calls fn for every lease in key order
+func (s *Store) Iterate(fn func(*leasestore.Lease) error) error {
+	leases, err := s.query("ORDER BY key")
+	if err != nil {
+		return err
+	}
+	for _, l := range leases {
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindByIP returns the leases holding ip
+func (s *Store) FindByIP(ip net.IP) ([]*leasestore.Lease, error) {
+	return s.query("WHERE ip = ?", ip.String())
+}
+
+// FindByMac returns the leases of mac
+func (s *Store) FindByMac(mac net.HardwareAddr) ([]*leasestore.Lease, error) {
+	return s.query("WHERE mac = ?", mac.String())
+}
+
+// FindByRole returns the leases of the role
+func (s *Store) FindByRole(role string) ([]*leasestore.Lease, error) {
+	return s.query("WHERE role = ?", role)
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,342 @@
+// Package textfile stores the leases in a text journal file
+package textfile
+
+// The lease file is a journal: a header line, then one line per lease change,
+//   mac ip expiry role state clientid crc
+// clientid is "-" when there is none, crc is the crc32 of the line before it. The last
+// line of a lease key wins, a deleted lease is written with the state "deleted". Files
+// without a header are the old "mac ip expiry role" format, they are migrated by the
+// compaction done at open.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"minidhcp/base"
+	"minidhcp/options/leasestore"
+)
+
+var log = base.GetLogger("textfile")
+
+const (
+	header = "# minidhcp lease journal v2"
+	// compact once the journal has this many lines more than the live leases
+	compactLines = 1000
+
+	stateDeleted = "deleted"
+)
+
+// Store keeps all leases in memory and appends every change to the journal
+type Store struct {
+	path   string
+	file   *os.File
+	lines  int // lines appended since the last compaction
+	leases map[string]*leasestore.Lease
+	l      sync.Mutex
+}
+
+// Open loads the leases from path and compacts it, so appends start on a clean file
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load() error {
+	s.leases = make(map[string]*leasestore.Lease)
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open lease file %s: %w", s.path, err)
+	}
+	defer file.Close()
+
+	var lines []string
+	sc := bufio.NewScanner(file)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); len(line) != 0 {
+			lines = append(lines, line)
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return fmt.Errorf("failed to read lease file %s: %w", s.path, err)
+	}
+
+	parse := parseLine
+	switch {
+	case len(lines) != 0 && lines[0] == header:
+		lines = lines[1:]
+	default:
+		log.Warningf("Lease file %s has no journal header, migrating the old format", s.path)
+		parse = parseLegacyLine
+	}
+	for i, line := range lines {
+		l, err := parse(line)
+		if err != nil && i == len(lines)-1 {
+			// crash while appending, the lease was never acked
+			log.Warningf("Lease file %s: dropping truncated last line: %v", s.path, err)
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("lease file %s line %d: %v", s.path, i+1, err)
+		}
+		if l.State == stateDeleted {
+			delete(s.leases, l.Key())
+		} else {
+			s.leases[l.Key()] = l
+		}
+	}
+	return nil
+}
+
+func formatLine(l *leasestore.Lease) string {
+	ip := l.IP
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	role := l.Role
+	if role == "" {
+		role = "-"
+	}
+	clientId := l.ClientId
+	if clientId == "" {
+		clientId = "-"
+	}
+	line := fmt.Sprintf("%s %s %d %s %s %s", l.Mac, ip, l.Expires.Unix(), role, l.State, clientId)
+	return fmt.Sprintf("%s %08x\n", line, crc32.ChecksumIEEE([]byte(line)))
+}
+
+func parseLine(line string) (*leasestore.Lease, error) {
+	tokens, err := checkLine(line, 6)
+	if err != nil {
+		return nil, err
+	}
+	l, err := parseFields(tokens[:4])
+	if err != nil {
+		return nil, err
+	}
+	l.State = tokens[4]
+	if tokens[5] != "-" {
+		l.ClientId = tokens[5]
+	}
+	return l, nil
+}
+
+// checkLine verifies the crc at the end of line and splits the rest in n fields
+func checkLine(line string, n int) ([]string, error) {
+	i := strings.LastIndexByte(line, ' ')
+	if i < 0 {
+		return nil, fmt.Errorf("malformed line, no checksum: %s", line)
+	}
+	sum, err := strconv.ParseUint(line[i+1:], 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE([]byte(line[:i])) {
+		return nil, fmt.Errorf("checksum mismatch: %s", line)
+	}
+	tokens := strings.Fields(line[:i])
+	if len(tokens) != n {
+		return nil, fmt.Errorf("malformed line, want %d fields, got %d: %s", n, len(tokens), line)
+	}
+	return tokens, nil
+}
+
+func parseLegacyLine(line string) (*leasestore.Lease, error) {
+	tokens := strings.Fields(line)
+	if len(tokens) != 4 {
+		return nil, fmt.Errorf("malformed line, want 4 fields, got %d: %s", len(tokens), line)
+	}
+	l, err := parseFields(tokens)
+	if err != nil {
+		return nil, err
+	}
+	// only bound leases were written, ended ones with the end time
+	l.State = "bound"
+	return l, nil
+}
+
+// parseFields parses "mac ip expiry role"
+func parseFields(tokens []string) (*leasestore.Lease, error) {
+	hwaddr, err := net.ParseMAC(tokens[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed hardware address: %s", tokens[0])
+	}
+
+	ipaddr := net.ParseIP(tokens[1])
+	if ipaddr.To4() == nil {
+		return nil, fmt.Errorf("expected an IPv4 address, got: %v", ipaddr)
+	}
+
+	expires, err := strconv.ParseInt(tokens[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("expected time of exipry in unix timestamp int64 sec format, got: %v", tokens[2])
+	}
+
+	role := tokens[3]
+	if role == "-" {
+		role = ""
+	}
+	return &leasestore.Lease{Mac: hwaddr.String(), IP: ipaddr.To4(), Expires: time.Unix(expires, 0), Role: role}, nil
+}
+
+// append writes out the lease changes and syncs them to disk at once
+func (s *Store) append(ls []*leasestore.Lease) error {
+	var lines strings.Builder
+	for _, l := range ls {
+		lines.WriteString(formatLine(l))
+	}
+	_, err := s.file.WriteString(lines.String())
+	if err != nil {
+		return fmt.Errorf("leasefile.WriteString() %s: %s", err, lines.String())
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return fmt.Errorf("leasefile.Sync() %s", err)
+	}
+	s.lines += len(ls)
+	if s.lines >= compactLines+len(s.leases) {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact writes a snapshot of the leases to a temp file and renames it over the journal
+func (s *Store) compact() error {
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create lease snapshot %s: %w", tmp, err)
+	}
+	w := bufio.NewWriter(file)
+	w.WriteString(header + "\n")
+	for _, l := range s.leases {
+		w.WriteString(formatLine(l))
+	}
+	if err = w.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write lease snapshot %s: %w", tmp, err)
+	}
+	file.Close()
+
+	if err = os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace lease file %s: %w", s.path, err)
+	}
+	// make the rename durable
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lease file %s: %w", s.path, err)
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	s.lines = 0
+	return nil
+}
+
+// Get returns the lease of key
+func (s *Store) Get(key string) (*leasestore.Lease, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	l, ok := s.leases[key]
+	if !ok {
+		return nil, leasestore.ErrNotFound
+	}
+	c := *l
+	return &c, nil
+}
+
+// Put appends the lease to the journal
+func (s *Store) Put(l *leasestore.Lease) error {
+	return s.Write([]leasestore.Change{{Lease: l}})
+}
+
+// Delete appends a deleted line for key to the journal
+func (s *Store) Delete(key string) error {
+	return s.Write([]leasestore.Change{{Key: key}})
+}
+
+// Write appends the changes to the journal with a single sync
+func (s *Store) Write(changes []leasestore.Change) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	lines := make([]*leasestore.Lease, 0, len(changes))
+	for _, ch := range changes {
+		if ch.Lease != nil {
+			c := *ch.Lease
+			s.leases[c.Key()] = &c
+			lines = append(lines, &c)
+			continue
+		}
+		if l, ok := s.leases[ch.Key]; ok {
+			delete(s.leases, ch.Key)
+			lines = append(lines, &leasestore.Lease{Mac: l.Mac, ClientId: l.ClientId, State: stateDeleted})
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return s.append(lines)
+}
+
+// Iterate calls fn for a copy of every lease
+func (s *Store) Iterate(fn func(*leasestore.Lease) error) error {
+	s.l.Lock()
+	leases := make([]leasestore.Lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		leases = append(leases, *l)
+	}
+	s.l.Unlock()
+
+	for i := range leases {
+		if err := fn(&leases[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindByIP returns the leases holding ip
+func (s *Store) FindByIP(ip net.IP) ([]*leasestore.Lease, error) {
+	return leasestore.Find(s, func(l *leasestore.Lease) bool { return l.IP.Equal(ip) })
+}
+
+// FindByMac returns the leases of mac
+func (s *Store) FindByMac(mac net.HardwareAddr) ([]*leasestore.Lease, error) {
+	return leasestore.Find(s, func(l *leasestore.Lease) bool { return l.Mac == mac.String() })
+}
+
+// FindByRole returns the leases of the role
+func (s *Store) FindByRole(role string) ([]*leasestore.Lease, error) {
+	return leasestore.Find(s, func(l *leasestore.Lease) bool { return l.Role == role })
+}
+
+// Close closes the journal, every change is already synced
+func (s *Store) Close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.file.Close()
+}
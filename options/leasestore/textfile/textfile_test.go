@@ -0,0 +1,120 @@
+package textfile
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"minidhcp/options/leasestore"
+)
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease.txt")
+	future := time.Now().Add(time.Hour).Unix()
+	legacy := "ea:42:a2:4d:ca:66 10.10.10.100 1659507755 staff\n" +
+		"5d:02:34:ba:49:f0 10.10.10.101 " + strconv.FormatInt(future, 10) + " guest\n" +
+		"ea:42:a2:4d:ca:66 10.10.10.102 1659508735 staff\n"
+	if err := ioutil.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	l, err := s.Get("ea:42:a2:4d:ca:66")
+	if err != nil || !l.IP.Equal(net.IPv4(10, 10, 10, 102)) || l.State != "bound" {
+		t.Fatalf("lease %+v %v", l, err)
+	}
+	if l, err := s.Get("5d:02:34:ba:49:f0"); err != nil || l.Expires.Unix() != future || l.Role != "guest" {
+		t.Fatalf("lease %+v %v", l, err)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if lines[0] != header || len(lines) != 3 {
+		t.Fatalf("migrated file:\n%s", b)
+	}
+
+	// client-id keyed leases are kept apart from the MAC keyed one
+	l = &leasestore.Lease{Mac: "ea:42:a2:4d:ca:66", ClientId: "01ea42a24dca66", IP: net.IPv4(10, 10, 10, 103).To4(), State: "bound"}
+	if err := s.Put(l); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get("id:01ea42a24dca66"); err != nil || got.ClientId != l.ClientId || got.Mac != l.Mac {
+		t.Fatalf("lease %+v %v", got, err)
+	}
+	if len(s.leases) != 3 {
+		t.Fatalf("leases %v", s.leases)
+	}
+}
+
+func TestTruncatedLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease.txt")
+	l := &leasestore.Lease{IP: net.IPv4(10, 10, 10, 100).To4(), Expires: time.Now(), Role: "staff", State: "bound"}
+	l.Mac = "00:00:00:00:00:01"
+	full := formatLine(l)
+	l.Mac = "00:00:00:00:00:02"
+	torn := formatLine(l)
+	torn = torn[:len(torn)-6]
+	if err := ioutil.WriteFile(path, []byte(header+"\n"+full+torn), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.leases) != 1 || s.leases["00:00:00:00:00:01"] == nil {
+		t.Fatalf("leases %v", s.leases)
+	}
+	s.Close()
+
+	// a torn line in the middle is corruption, not a crash
+	if err := ioutil.WriteFile(path, []byte(header+"\n"+torn+"\n"+full), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("expected an error for a corrupted line")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease.txt")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &leasestore.Lease{Mac: "00:00:00:00:00:01", IP: net.IPv4(10, 10, 10, 100).To4(), Role: "staff", State: "bound"}
+	for i := 0; i <= compactLines; i++ {
+		l.Expires = time.Unix(int64(1659507755+i), 0)
+		if err := s.Put(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, _ := ioutil.ReadFile(path)
+	if n := strings.Count(string(b), "\n"); n != 2 {
+		t.Fatalf("compacted file has %d lines, want 2", n)
+	}
+
+	// appends go to the new file
+	l.Expires = l.Expires.Add(time.Hour)
+	if err := s.Put(l); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, err := s.Get(l.Mac); err != nil || !got.Expires.Equal(l.Expires) {
+		t.Fatalf("lease %+v %v", got, err)
+	}
+}
@@ -1,17 +1,16 @@
 package options
 
 import (
-	"bufio"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"minidhcp/base"
-	"minidhcp/options/allocators"
-	"minidhcp/options/allocators/bitmap"
+	"minidhcp/options/leasestore"
+	"minidhcp/options/leasestore/boltdb"
+	"minidhcp/options/leasestore/sqlite"
+	"minidhcp/options/leasestore/textfile"
 	"net"
-	"os"
-	"strconv"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
@@ -20,108 +19,486 @@ import (
 
 var log = base.GetLogger("options")
 
-var roleName = []string{"staff", "guest", "boss"}
+const (
+	// how long a declined IP is kept out of the pool if not configured
+	defaultQuarantineTime = 24 * time.Hour
+	// how long an offered IP is held for the REQUEST if not configured
+	defaultOfferTime = 30 * time.Second
+	// how long an expired IP is kept for the client if not configured
+	defaultLeaseGrace = 5 * time.Minute
+)
 
-//Record holds an IP lease record
-type Record struct {
+// Quarantine holds an IP declined by a client, it stays taken in the allocator until expires
+type Quarantine struct {
 	IP      net.IP
-	expires time.Time
-	role    string
+	Mac     string // of the client that declined it, "" if abandoned
+	Role    string
+	Reason  string // declined or abandoned
+	Expires time.Time
 }
 
 type Options struct {
-	// Rough lock for the whole plugin, we'll get better performance once we use leasestorage
-	sync.Mutex
-	// Recordsv4 holds a MAC -> IP address and lease time mapping
-	Recordsv4  map[string]*Record
-	leasefile  *os.File
-	leaseTimes []time.Duration
-	allocs     []allocators.Allocator
+	// admin is read locked by the requests, which then lock their client, see lockClient,
+	// and write locked by the reaper and the changes of roles and reservations
+	admin   sync.RWMutex
+	clients [shards]sync.Mutex // by shard of the client key
+	closed  bool
+	// records holds the leases by client key, MAC and IP
+	records *leaseIndex
+	// quarantine holds the declined and abandoned IPs, by IP
+	quarantine     map[string]*Quarantine
+	quarantineMu   sync.Mutex
+	quarantineTime time.Duration
+	offerTime      time.Duration
+	leaseGrace     time.Duration
+	subscribers    []func(Event)
+	leases         leasestore.LeaseStore
+	commits        *committer    // batches the writes to leases
+	reapNow        chan struct{} // asks the reaper for a pass when a pool runs out
 
-	conf    *base.Config
-	subnets []base.Subnet
+	conf     *base.Config
+	roles    []*role
+	rules    []*rule
+	fallback int // role of the clients no rule matches and the lookup doesn't know
+	lookup   RoleLookup
+	assigned map[string]string // roles set by SetRole, by MAC
+	hosts    map[string]*host  // reservations, by MAC or client-id
+	ifaces   map[string]*iface // served interfaces, by name
+	prober   Prober            // probes the new IPs before they are offered, nil if none
+	probes   chan struct{}     // a token per background probe, bounds them
+	probing  sync.WaitGroup    // the background probes, Close waits for them
+	// probingKeys holds the clients whose offer is probed
+	probingKeys map[string]bool
+	probingMu   sync.Mutex
+	audit       *auditLog
 }
 
 // TODO  serverid push 1st plugin
-func New(conf *base.Config) *Options {
-	subnets := []base.Subnet{conf.Staff, conf.Guest, conf.Boss}
+func New(conf *base.Config) (*Options, error) {
 	ops := Options{
-		conf:    conf,
-		subnets: subnets,
+		conf: conf,
+	}
+	if err := ops.Setup4(conf.Roles); err != nil {
+		return nil, err
 	}
-	ops.Setup4(subnets)
-	log.Infof("NewOptions subnets: %v", subnets)
+	log.Infof("NewOptions roles: %v", conf.Roles)
 
-	return &ops
+	return &ops, nil
 }
 
-func (o *Options) findSubnetIndex(req *dhcpv4.DHCPv4) int {
-	mac := req.ClientHWAddr.String()
-	record, ok := o.Recordsv4[mac]
-	if !ok {
-		// TODO rest client request controlcenter, GET /auth/mac=?
-		return 0
-	}
-	for i, role := range roleName {
-		if role == record.role {
+// findSubnetIndexByIP returns the role whose subnet holds ip, -1 if there is none
+func (o *Options) findSubnetIndexByIP(ip net.IP) int {
+	for i, r := range o.roles {
+		if r.subnetContains(ip) {
 			return i
 		}
 	}
-	return 0
+	return -1
+}
+
+func (o *Options) roleIndex(role string) int {
+	idx, _ := o.findRole(role)
+	return idx
+}
+
+// findRole returns the index of the role, false if no such role
+func (o *Options) findRole(name string) (int, bool) {
+	for i, r := range o.roles {
+		if r.name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// lockClient locks the lease of the client key against the other requests of the
+// client, and read locks admin. It returns the unlock.
+func (o *Options) lockClient(key string) func() {
+	o.admin.RLock()
+	mu := &o.clients[shardOf(key)]
+	mu.Lock()
+	return func() {
+		mu.Unlock()
+		o.admin.RUnlock()
+	}
+}
+
+// Handle fills resp for req received on ifname, returns false when no response should be sent.
+// No new IP is offered once ctx is done. A new IP is probed before Handle returns, see
+// HandleLater.
+func (o *Options) Handle(ctx context.Context, ifname string, req, resp *dhcpv4.DHCPv4) bool {
+	return o.HandleLater(ctx, ifname, req, resp, nil)
+}
+
+// HandleLater is Handle, except a new IP is probed in the background: it returns false
+// and later gets resp once the offer is done, from another goroutine. later is not
+// called if no IP is found free.
+func (o *Options) HandleLater(ctx context.Context, ifname string, req, resp *dhcpv4.DHCPv4, later Reply) bool {
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRelease:
+		o.Handler4Release(req)
+		return false
+	case dhcpv4.MessageTypeDecline:
+		o.Handler4Decline(req)
+		return false
+	case dhcpv4.MessageTypeInform:
+		// static IP client only wants the options, no lease and no yiaddr
+		idxSubnet := o.findSubnetIndexByIP(req.ClientIPAddr)
+		if idxSubnet < 0 {
+			idxSubnet = o.findSubnetIndex(req, ifname)
+		}
+		if idxSubnet < 0 {
+			return false
+		}
+		o.Handler4Other(req, resp, idxSubnet)
+		o.handler4ServerId(req, resp, o.serverId(ifname))
+		return true
+	}
+
+	idxSubnet := o.findSubnetIndex(req, ifname)
+	if idxSubnet < 0 {
+		return false
+	}
+	if req.MessageType() == dhcpv4.MessageTypeRequest {
+		switch verdict, reason := o.checkRequest(req, ifname, idxSubnet); verdict {
+		case requestIgnore:
+			log.Infof("DHCPREQUEST from MAC %s ignored: %s", req.ClientHWAddr, reason)
+			return false
+		case requestNak:
+			log.Infof("DHCPREQUEST from MAC %s NAKed: %s", req.ClientHWAddr, reason)
+			o.Handler4Nak(resp, reason)
+			o.handler4ServerId(req, resp, o.serverId(ifname))
+			return true
+		}
+	}
+	if !o.Handler4(ctx, req, resp, idxSubnet) {
+		return false
+	}
+	finish := func() {
+		o.Handler4Other(req, resp, idxSubnet)
+		o.handler4ServerId(req, resp, o.serverId(ifname))
+	}
+	if req.MessageType() == dhcpv4.MessageTypeDiscover {
+		var probed Reply
+		if later != nil {
+			probed = func(resp *dhcpv4.DHCPv4) {
+				finish()
+				later(resp)
+			}
+		}
+		if !o.probeOffer(ctx, req, resp, idxSubnet, probed) {
+			return false
+		}
+	}
+	finish()
+	return true
+}
+
+type requestVerdict int
+
+const (
+	requestAck requestVerdict = iota
+	requestNak
+	requestIgnore
+)
+
+// checkRequest decides how to answer a DHCPREQUEST received on ifname by the client state,
+// see RFC 2131 4.3.2
+func (o *Options) checkRequest(req *dhcpv4.DHCPv4, ifname string, idxSubnet int) (requestVerdict, string) {
+	srvid := o.serverId(ifname)
+	reqIP := req.RequestedIPAddress()
+	key, _ := clientKey(req)
+	defer o.lockClient(key)()
+	record, ok := o.records.get(key)
+	if ok && !record.held() {
+		ok = false
+	}
+	switch {
+	case req.ServerIdentifier() != nil:
+		// SELECTING: the client answers one of the offers
+		if !req.ServerIdentifier().Equal(srvid) {
+			return requestIgnore, "client selected another server"
+		}
+		if !ok || !record.IP.Equal(reqIP) {
+			return requestNak, "requested IP was not offered"
+		}
+	case reqIP != nil:
+		// INIT-REBOOT: the client verifies a previously allocated IP
+		if !o.roles[idxSubnet].subnetContains(reqIP) {
+			return requestNak, "requested IP is on the wrong network"
+		}
+		if !ok {
+			return requestIgnore, "no record of the client"
+		}
+		if !record.IP.Equal(reqIP) {
+			return requestNak, "requested IP is not leased to the client"
+		}
+	default:
+		// RENEWING (unicast) or REBINDING (broadcast): the IP is in ciaddr, a lease of
+		// another server's network is none of our business
+		if !ok || !record.IP.Equal(req.ClientIPAddr) {
+			if !o.onLink(req, ifname, req.ClientIPAddr) {
+				return requestIgnore, "client IP is not on a served network"
+			}
+			return requestNak, "client IP is not leased to the client"
+		}
+	}
+	if record.role != o.roles[idxSubnet].name {
+		// the relay tells the client is on another network than its lease
+		return requestNak, "lease is on another network"
+	}
+	return requestAck, ""
 }
 
-func (o *Options) Handle(req, resp *dhcpv4.DHCPv4) {
-	idxSubnet := o.findSubnetIndex(req)
-	o.Handler4(req, resp, idxSubnet)
-	o.Handler4Other(req, resp, idxSubnet)
-	o.handler4ServerId(req, resp)
+// Handler4Nak turns resp into a DHCPNAK, it carries no IP and no lease
+func (o *Options) Handler4Nak(resp *dhcpv4.DHCPv4, msg string) {
+	resp.YourIPAddr = net.IPv4zero
+	resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+	resp.UpdateOption(dhcpv4.OptMessage(msg))
 }
 
-// Handler4 handles DHCPv4 packets for the range plugin
-func (o *Options) Handler4(req, resp *dhcpv4.DHCPv4, idxSubnet int) {
-	o.Lock()
-	defer o.Unlock()
-	alloc, leasetime := o.allocs[idxSubnet], o.leaseTimes[idxSubnet]
-	mac := req.ClientHWAddr.String()
-	record, ok := o.Recordsv4[mac]
-	if !ok {
-		rec := o.createNewIP(alloc, mac, leasetime, roleName[idxSubnet])
-		err := o.saveIPAddress(req.ClientHWAddr, rec)
-		if rec == nil || err != nil {
-			log.Errorf("SaveIPAddress for MAC %s failed: %v", mac, err)
-			return
+// Handler4 handles DHCPv4 packets for the range plugin.
+// DISCOVER only holds an offered IP in memory, the lease is bound and persisted on REQUEST.
+// The ACK waits for the lease to be durable, with the locks released. No new IP is
+// allocated once ctx is done.
+func (o *Options) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4, idxSubnet int) bool {
+	ok, saved := o.handler4(ctx, req, resp, idxSubnet)
+	if saved != nil && saved.wait() != nil {
+		return false
+	}
+	return ok
+}
+
+// handler4 is Handler4 under the client lock, it returns the write of the bound lease
+// if there is one
+func (o *Options) handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4, idxSubnet int) (bool, *commit) {
+	role := o.roles[idxSubnet]
+	leasetime := role.leaseTime
+	key, clientId := clientKey(req)
+	defer o.lockClient(key)()
+	record, ok := o.records.get(key)
+	h := o.findHost(req)
+	if h != nil && h.leaseTime != 0 {
+		leasetime = h.leaseTime
+	}
+	if ok && h != nil && !record.IP.Equal(h.ip) {
+		// reserved after the lease was given, move to the reserved IP
+		if record.held() {
+			if err := o.roles[o.roleIndex(record.role)].free(record.IP); err != nil {
+				log.Warningf("Free IP %s for client %s: %v", record.IP, key, err)
+			}
+		}
+		o.dropRecord(key)
+		ok = false
+	}
+	if ok && record.held() && record.role != role.name {
+		// classified after the last offer, or relayed from another network now,
+		// offer from the right role
+		if record.state == leaseOffered {
+			o.forgetOffer(key, record)
+		} else {
+			if err := o.roles[o.roleIndex(record.role)].free(record.IP); err != nil {
+				log.Warningf("Free IP %s of role %s: %v", record.IP, record.role, err)
+			}
+			o.dropRecord(key)
+		}
+		ok = false
+	}
+	if ok && record.state == leaseExpired && req.MessageType() == dhcpv4.MessageTypeDiscover {
+		// still in the grace period, offer the held IP again
+		record.setState(leaseOffered)
+	}
+	if !ok || !record.held() {
+		if ctx.Err() != nil {
+			log.Infof("Client %s gets no new IP, request timed out or shutting down", key)
+			return false, nil
 		}
-		o.Recordsv4[mac] = rec
+		hint := requestedHint(req)
+		if hint == nil && ok && record.state != leaseDeclined && record.state != leaseAbandoned {
+			// released or expired IP went back to the pool, try to get the same one again
+			hint = record.IP
+		}
+		// the retransmission of a DISCOVER whose IP was abandoned was charged already
+		retry := ok && record.state == leaseAbandoned && record.xid == req.TransactionID
+		var rec *Record
+		if h != nil {
+			rec = &Record{IP: h.ip, expires: time.Now().Add(o.offerTime).Round(time.Second), role: role.name, state: leaseOffered}
+		} else if retry || o.allowNew(role, req) {
+			rec = o.createNewIP(role, key, o.offerTime, hint)
+		}
+		if rec == nil {
+			return false, nil
+		}
+		rec.mac, rec.clientId, rec.xid = req.ClientHWAddr.String(), clientId, req.TransactionID
+		o.records.add(rec)
 		record = rec
-	} else {
+	}
+
+	var saved *commit
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		if record.state == leaseOffered {
+			record.expires = time.Now().Add(o.offerTime).Round(time.Second)
+		}
+	case dhcpv4.MessageTypeRequest:
+		// a relay may rewrite chaddr, the lease follows the client-id
+		mac := record.mac
+		record.mac = req.ClientHWAddr.String()
+		o.records.moveMac(record, mac)
 		// Ensure we extend the existing lease at least past when the one we're giving expires
-		if record.expires.Before(time.Now().Add(leasetime)) {
-			record.expires = time.Now().Add(leasetime).Round(time.Second)
-			err := o.saveIPAddress(req.ClientHWAddr, record)
-			if err != nil {
-				log.Errorf("Could not persist lease for MAC %s: %v", mac, err)
-				return
+		if record.state != leaseBound || record.expires.Before(time.Now().Add(leasetime)) {
+			if err := record.setState(leaseBound); err != nil {
+				log.Errorf("Could not bind lease for client %s: %v", key, err)
+				return false, nil
 			}
+			record.expires = time.Now().Add(leasetime).Round(time.Second)
+			saved = o.saveRecord(record)
 		}
 	}
 	resp.YourIPAddr = record.IP
 	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(leasetime.Round(time.Second)))
-	log.Printf("found IP address %s for MAC %s", record.IP, mac)
+	log.Printf("found IP address %s for client %s, lease %v", record.IP, key, record.state)
+	return true, saved
+}
+
+// Handler4Release gives the released IP back to the role's allocator
+func (o *Options) Handler4Release(req *dhcpv4.DHCPv4) {
+	key, _ := clientKey(req)
+	defer o.lockClient(key)()
+	record, ok := o.records.get(key)
+	if !ok || record.state != leaseBound {
+		log.Infof("DHCPRELEASE from client %s without lease, ignoring", key)
+		return
+	}
+	// the client puts the released address in ciaddr
+	if !record.IP.Equal(req.ClientIPAddr) {
+		log.Warningf("DHCPRELEASE from client %s for %s, but leased %s, ignoring", key, req.ClientIPAddr, record.IP)
+		return
+	}
+
+	err := o.roles[o.roleIndex(record.role)].free(record.IP)
+	if err != nil {
+		log.Warningf("Free IP %s for client %s: %v", record.IP, key, err)
+	}
+	record.setState(leaseReleased)
+	record.expires = time.Now().Round(time.Second)
+	o.saveRecord(record)
+	log.Printf("released IP address %s for client %s", record.IP, key)
+}
+
+// Handler4Decline quarantines the declined IP, the client has to DISCOVER again
+func (o *Options) Handler4Decline(req *dhcpv4.DHCPv4) {
+	key, _ := clientKey(req)
+	ip := req.RequestedIPAddress()
+	defer o.lockClient(key)()
+	record, ok := o.records.get(key)
+	if !ok || !record.active() || !record.IP.Equal(ip) {
+		log.Warningf("DHCPDECLINE from client %s for %s without lease, ignoring", key, ip)
+		return
+	}
+
+	// keep the IP taken in the allocator, so it's not offered again
+	q := &Quarantine{
+		IP:      record.IP,
+		Mac:     record.mac,
+		Role:    record.role,
+		Reason:  leaseDeclined.String(),
+		Expires: time.Now().Add(o.quarantineTime).Round(time.Second),
+	}
+	o.quarantineIP(q)
+	wasBound := record.state == leaseBound
+	record.setState(leaseDeclined)
+	record.expires = time.Now().Round(time.Second)
+	if wasBound {
+		o.saveRecord(record)
+	}
+	log.Warningf("Client %s declined IP address %s, quarantined until %v", key, ip, q.Expires)
+}
+
+// Quarantined returns a copy of the declined and abandoned IPs
+func (o *Options) Quarantined() []Quarantine {
+	o.quarantineMu.Lock()
+	defer o.quarantineMu.Unlock()
+	qs := make([]Quarantine, 0, len(o.quarantine))
+	for _, q := range o.quarantine {
+		qs = append(qs, *q)
+	}
+	return qs
+}
+
+// quarantineIP keeps the IP of q out of the pool until it expires
+func (o *Options) quarantineIP(q *Quarantine) {
+	o.quarantineMu.Lock()
+	defer o.quarantineMu.Unlock()
+	o.quarantine[q.IP.String()] = q
+}
+
+// expireQuarantine gives the IPs back to the allocator once quarantine is over
+func (o *Options) expireQuarantine(now time.Time) {
+	o.quarantineMu.Lock()
+	defer o.quarantineMu.Unlock()
+	for ip, q := range o.quarantine {
+		if q.Expires.After(now) {
+			continue
+		}
+		err := o.roles[o.roleIndex(q.Role)].free(q.IP)
+		if err != nil {
+			log.Warningf("Free quarantined IP %s: %v", ip, err)
+		}
+		delete(o.quarantine, ip)
+		log.Printf("quarantine of IP address %s is over", ip)
+	}
+}
+
+// expireOffers gives back the offered IPs not followed by a REQUEST in time and forgets
+// the abandoned offers, admin is write locked
+func (o *Options) expireOffers(now time.Time) {
+	for _, key := range o.records.keys() {
+		rec, ok := o.records.get(key)
+		if !ok || (rec.state != leaseOffered && rec.state != leaseAbandoned) || rec.expires.After(now) {
+			continue
+		}
+		o.forgetOffer(key, rec)
+	}
+}
+
+// forgetOffer forgets the client of the offer rec, offers are never persisted. An
+// offered IP goes back to its role, an abandoned one is in quarantine.
+func (o *Options) forgetOffer(key string, rec *Record) {
+	if rec.state == leaseOffered {
+		if err := o.roles[o.roleIndex(rec.role)].free(rec.IP); err != nil {
+			log.Warningf("Free offered IP %s: %v", rec.IP, err)
+		}
+	}
+	o.records.remove(key)
 }
 
 func (o *Options) Handler4Other(req, resp *dhcpv4.DHCPv4, idxSubnet int) {
-	subnet := o.subnets[idxSubnet]
+	subnet := o.roles[idxSubnet].subnet
+	router, dns := subnet.Router, subnet.Dns
+	o.admin.RLock()
+	if h := o.findHost(req); h != nil {
+		if h.Router != "" {
+			router = h.Router
+		}
+		if h.Dns != "" {
+			dns = h.Dns
+		}
+		if h.Hostname != "" {
+			resp.Options.Update(dhcpv4.OptHostName(h.Hostname))
+		}
+	}
+	o.admin.RUnlock()
 	resp.Options.Update(dhcpv4.OptSubnetMask(net.IPMask(net.ParseIP(subnet.Netmask).To4())))
-	resp.Options.Update(dhcpv4.OptRouter(net.ParseIP(subnet.Router)))
-	resp.Options.Update(dhcpv4.OptDNS(net.ParseIP(subnet.Dns)))
+	resp.Options.Update(dhcpv4.OptRouter(net.ParseIP(router)))
+	resp.Options.Update(dhcpv4.OptDNS(net.ParseIP(dns)))
 }
 
-func (o *Options) handler4ServerId(req, resp *dhcpv4.DHCPv4) {
+func (o *Options) handler4ServerId(req, resp *dhcpv4.DHCPv4, srvid net.IP) {
 	if req.OpCode != dhcpv4.OpcodeBootRequest {
 		log.Warningf("not a BootRequest, ignoring")
 		return
 	}
-	srvid := net.ParseIP(o.conf.ServerId)
 	if req.ServerIPAddr != nil &&
 		!req.ServerIPAddr.Equal(net.IPv4zero) &&
 		!req.ServerIPAddr.Equal(srvid) {
@@ -136,119 +513,291 @@ func (o *Options) handler4ServerId(req, resp *dhcpv4.DHCPv4) {
 
 // TODO，reentry
 func (o *Options) Setup4(subnets []base.Subnet) (err error) {
-	o.subnets = subnets
-	// new allocs/leasetimes array
-	for _, sub := range subnets {
-		alloc, err := o.createAllocator(sub.IpStart, sub.IpStop)
+	// the reservations look up the leases holding their IPs
+	o.records = newLeaseIndex()
+	if err = o.setupRoles(subnets); err != nil {
+		return err
+	}
+
+	o.quarantineTime = defaultQuarantineTime
+	if o.conf.Quarantine != "" {
+		o.quarantineTime, err = time.ParseDuration(o.conf.Quarantine)
+		if err != nil {
+			return fmt.Errorf("invalid quarantine duration: %v", o.conf.Quarantine)
+		}
+	}
+	o.quarantine = make(map[string]*Quarantine)
+
+	o.leaseGrace = defaultLeaseGrace
+	if o.conf.LeaseGrace != "" {
+		o.leaseGrace, err = time.ParseDuration(o.conf.LeaseGrace)
 		if err != nil {
-			return fmt.Errorf("could not create an allocator: %w", err)
+			return fmt.Errorf("invalid lease grace duration: %v", o.conf.LeaseGrace)
 		}
-		o.allocs = append(o.allocs, alloc)
+	}
 
-		leaseTime, err := time.ParseDuration(sub.LeaseTime)
+	o.offerTime = defaultOfferTime
+	if o.conf.OfferTime != "" {
+		o.offerTime, err = time.ParseDuration(o.conf.OfferTime)
 		if err != nil {
-			return fmt.Errorf("invalid lease duration: %v", sub.LeaseTime)
+			return fmt.Errorf("invalid offer duration: %v", o.conf.OfferTime)
 		}
-		o.leaseTimes = append(o.leaseTimes, leaseTime)
 	}
 
-	file, err := os.OpenFile("lease.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err = o.setupAssigned(); err != nil {
+		return err
+	}
+	o.audit, err = openAudit(o.conf.AuditLog)
 	if err != nil {
-		return fmt.Errorf("failed to open lease file %s: %w", "lease.txt", err)
+		return err
 	}
-	o.leasefile = file
 
-	r, err := o.loadRecords()
+	o.leases, err = o.createLeaseStore(o.conf.LeaseStore, o.conf.LeasePath)
 	if err != nil {
-		return fmt.Errorf("could not load records from file: %v", err)
+		return fmt.Errorf("could not open lease store: %w", err)
+	}
+	o.commits = newCommitter(o.leases)
+	o.reapNow = make(chan struct{}, 1)
+	o.probes = make(chan struct{}, maxProbing)
+	o.probingKeys = make(map[string]bool)
+	records, err := o.loadRecords()
+	if err != nil {
+		return fmt.Errorf("could not load records from store: %v", err)
 	}
-	o.Recordsv4 = r
 
-	log.Printf("Loaded %d DHCPv4 leases from lease.txt", len(o.Recordsv4))
+	log.Printf("Loaded %d DHCPv4 leases from %s store", len(records), o.conf.LeaseStore)
+	o.reserveRecords(records)
+	for _, rec := range records {
+		o.records.add(rec)
+	}
 	return
 }
 
-func (o *Options) createNewIP(allocator allocators.Allocator, mac string, leaseTime time.Duration, roleName string) *Record {
-	// Allocating new address since there isn't one allocated
-	log.Printf("MAC address %s is new, leasing new IPv4 address", mac)
-	ip, err := allocator.Allocate(net.IPNet{})
-	if err != nil {
-		log.Errorf("Could not allocate IP for MAC %s: %v", mac, err)
-		return nil
+// setupRoles creates the allocators of every role, the first role is the default one
+func (o *Options) setupRoles(subnets []base.Subnet) error {
+	if len(subnets) == 0 {
+		return errors.New("no roles configured")
 	}
-	rec := Record{
-		IP:      ip.IP.To4(),
-		expires: time.Now().Add(leaseTime),
-		role:    roleName,
+	o.roles = nil
+	for _, sub := range subnets {
+		if _, ok := o.findRole(sub.Role); ok {
+			return fmt.Errorf("role %s configured twice", sub.Role)
+		}
+		r, err := newRole(sub)
+		if err != nil {
+			return err
+		}
+		if err = r.overlapAny(o.roles); err != nil {
+			return err
+		}
+		o.roles = append(o.roles, r)
 	}
-	return &rec
-}
 
-func (o *Options) createAllocator(ipstart, ipend string) (allocators.Allocator, error) {
-	ipRangeStart := net.ParseIP(ipstart)
-	if ipRangeStart.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", ipstart)
+	o.fallback = 0
+	if o.conf.FallbackRole != "" {
+		idx, ok := o.findRole(o.conf.FallbackRole)
+		if !ok {
+			return fmt.Errorf("fallback role %s is not configured", o.conf.FallbackRole)
+		}
+		o.fallback = idx
 	}
-	ipRangeEnd := net.ParseIP(ipend)
-	if ipRangeEnd.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", ipend)
+	if err := o.setupRules(o.conf.Rules); err != nil {
+		return err
 	}
-	if binary.BigEndian.Uint32(ipRangeStart.To4()) >= binary.BigEndian.Uint32(ipRangeEnd.To4()) {
-		return nil, errors.New("start of IP range has to be lower than the end of an IP range")
+	if err := o.setupIfaces(); err != nil {
+		return err
 	}
+	return o.setupHosts()
+}
 
-	allocator, err := bitmap.NewIPv4Allocator(ipRangeStart, ipRangeEnd)
+// SetRanges sets the pools and the options of the roles of subs in the config, a role
+// not configured yet is added. The roles are checked as on startup, nothing is set if
+// one is invalid. The running roles are kept, the config is used on the next start.
+func (o *Options) SetRanges(subs []base.Subnet) error {
+	o.admin.Lock()
+	defer o.admin.Unlock()
+	roles := append([]base.Subnet(nil), o.conf.Roles...)
+	for _, sub := range subs {
+		idx := len(roles)
+		for i := range roles {
+			if roles[i].Role == sub.Role {
+				idx = i
+				break
+			}
+		}
+		if idx == len(roles) {
+			roles = append(roles, base.Subnet{Role: sub.Role})
+		}
+		rg := &roles[idx]
+		rg.IpStart, rg.IpStop, rg.Pools = sub.IpStart, sub.IpStop, sub.Pools
+		rg.Dns, rg.Router, rg.Netmask, rg.LeaseTime = sub.Dns, sub.Router, sub.Netmask, sub.LeaseTime
+	}
 
-	return allocator, err
+	var checked []*role
+	for _, sub := range roles {
+		r, err := newRole(sub)
+		if err != nil {
+			return err
+		}
+		if err = r.overlapAny(checked); err != nil {
+			return err
+		}
+		checked = append(checked, r)
+	}
+	o.conf.Roles = roles
+	return nil
 }
 
-// TODO, role
-func (o *Options) loadRecords() (map[string]*Record, error) {
-	sc := bufio.NewScanner(o.leasefile)
-	records := make(map[string]*Record)
-	for sc.Scan() {
-		line := sc.Text()
-		if len(line) == 0 {
-			continue
+// createLeaseStore opens the lease storage of the kind, "file" if not configured
+func (o *Options) createLeaseStore(kind, path string) (leasestore.LeaseStore, error) {
+	switch kind {
+	case "", "file":
+		if path == "" {
+			path = "lease.txt"
 		}
-		tokens := strings.Fields(line)
-		if len(tokens) != 4 {
-			return nil, fmt.Errorf("malformed line, want 4 fields, got %d: %s", len(tokens), line)
+		return textfile.Open(path)
+	case "bolt":
+		if path == "" {
+			path = "lease.db"
 		}
+		return boltdb.Open(path)
+	case "sqlite":
+		if path == "" {
+			path = "lease.sqlite"
+		}
+		return sqlite.Open(path)
+	}
+	return nil, fmt.Errorf("unknown lease store: %s", kind)
+}
 
-		hwaddr, err := net.ParseMAC(tokens[0])
+func (o *Options) loadRecords() (map[string]*Record, error) {
+	records := make(map[string]*Record)
+	err := o.leases.Iterate(func(l *leasestore.Lease) error {
+		rec, err := recordFromLease(l)
 		if err != nil {
-			return nil, fmt.Errorf("malformed hardware address: %s", tokens[0])
+			log.Warningf("Skipping stored lease of client %s: %v", l.Key(), err)
+			return nil
 		}
+		records[l.Key()] = rec
+		return nil
+	})
+	return records, err
+}
 
-		ipaddr := net.ParseIP(tokens[1])
-		if ipaddr.To4() == nil {
-			return nil, fmt.Errorf("expected an IPv4 address, got: %v", ipaddr)
+// reserveRecords marks the IPs of the loaded bound leases as used in the role's allocator.
+// The lease is dropped instead when its role is gone, its IP is out of the role's range,
+// or a newer lease holds the same IP; the client gets NAK on renew and DISCOVERs again.
+// Leases already over are dropped too, nothing holds their IPs.
+func (o *Options) reserveRecords(records map[string]*Record) {
+	drop := func(key string) {
+		delete(records, key)
+		o.commits.delete(key)
+	}
+	keys := make([]string, 0, len(records))
+	for key, rec := range records {
+		if rec.state == leaseBound && rec.expires.After(time.Now()) {
+			keys = append(keys, key)
+		} else {
+			drop(key)
 		}
+	}
+	// newest first, it wins an IP leased more than once
+	sort.Slice(keys, func(i, j int) bool {
+		return records[keys[i]].expires.After(records[keys[j]].expires)
+	})
 
-		expires, err := strconv.ParseInt(tokens[2], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("expected time of exipry in unix timestamp int64 sec format, got: %v", tokens[2])
+	reserved := 0
+	for _, key := range keys {
+		rec := records[key]
+		if h := o.recordHost(rec); h != nil {
+			// the reserved IP is taken already, the lease only has to be on it
+			if !h.ip.Equal(rec.IP) {
+				log.Warningf("Lease %s for client %s is not the reserved IP %s, dropped", rec.IP, key, h.ip)
+				drop(key)
+				continue
+			}
+			rec.role = o.roles[h.role].name
+			reserved++
+			continue
 		}
-		tm := time.Unix(expires, 0)
+		idx, ok := o.findRole(rec.role)
+		if !ok || !o.roles[idx].rangeContains(rec.IP) {
+			log.Warningf("Lease %s for client %s is out of the range of role %s, dropped", rec.IP, key, rec.role)
+			drop(key)
+			continue
+		}
+		if err := o.roles[idx].reserve(rec.IP); err != nil {
+			log.Warningf("Lease %s for client %s could not be reserved: %v, dropped", rec.IP, key, err)
+			drop(key)
+			continue
+		}
+		reserved++
+	}
+	log.Printf("Reserved %d of %d bound leases in the allocators", reserved, len(keys))
+}
 
-		role := tokens[3]
+// dropRecord forgets the client lease, in memory and in storage, the caller may wait
+// for the removal from storage like for saveRecord
+func (o *Options) dropRecord(key string) *commit {
+	o.records.remove(key)
+	return o.commits.delete(key)
+}
 
-		records[hwaddr.String()] = &Record{IP: ipaddr, expires: tm, role: role}
+// requestedHint returns the IP the client asks for, option 50 or ciaddr, so a client
+// whose lease was lost can get its old IP back
+func requestedHint(req *dhcpv4.DHCPv4) net.IP {
+	if ip := req.RequestedIPAddress(); ip != nil && !ip.IsUnspecified() {
+		return ip
 	}
-	return records, nil
+	if !req.ClientIPAddr.IsUnspecified() {
+		return req.ClientIPAddr
+	}
+	return nil
 }
 
-// saveIPAddress writes out a lease to storage
-func (o *Options) saveIPAddress(mac net.HardwareAddr, rec *Record) error {
-	s := fmt.Sprintf("%s %s %d %s\n", mac.String(), rec.IP.String(), rec.expires.Unix(), rec.role)
-	_, err := o.leasefile.WriteString(s)
+// createNewIP allocates the hinted IP if it's free and in the pools of the role, any free one otherwise
+func (o *Options) createNewIP(role *role, key string, leaseTime time.Duration, hint net.IP) *Record {
+	// Allocating new address since there isn't one allocated
+	log.Printf("Client %s is new, leasing new IPv4 address, hint %v", key, hint)
+	ip, err := role.allocate(hint)
 	if err != nil {
-		return fmt.Errorf("leasefile.WriteString() %s: %s", err, s)
+		log.Errorf("Could not allocate IP for client %s: %v", key, err)
+		// the client retransmits, an offer or a quarantine over may free an IP meanwhile
+		o.reapSoon()
+		return nil
 	}
-	err = o.leasefile.Sync()
-	if err != nil {
-		return fmt.Errorf("leasefile.Sync() %s", err)
+	rec := Record{
+		IP:      ip,
+		expires: time.Now().Add(leaseTime).Round(time.Second),
+		role:    role.name,
+		state:   leaseOffered,
+		probe:   o.prober != nil,
 	}
-	return nil
+	return &rec
+}
+
+// saveRecord queues the lease to be written to storage, the caller may wait for it
+// once its locks are released
+func (o *Options) saveRecord(rec *Record) *commit {
+	return o.commits.put(rec.lease())
+}
+
+// Leases returns the stored leases
+func (o *Options) Leases() ([]*leasestore.Lease, error) {
+	return leasestore.Find(o.leases, func(*leasestore.Lease) bool { return true })
+}
+
+// Close writes the queued lease changes and closes the lease storage
+func (o *Options) Close() error {
+	o.admin.Lock()
+	o.closed = true
+	o.admin.Unlock()
+	// no probe starts once closed, the running ones take the client locks
+	o.probing.Wait()
+
+	o.admin.Lock()
+	defer o.admin.Unlock()
+	o.audit.Close()
+	o.commits.close()
+	return o.leases.Close()
 }
@@ -0,0 +1,1233 @@
+package options
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"minidhcp/base"
+	"minidhcp/options/leasestore"
+	"minidhcp/options/leasestore/textfile"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func getOptions(t testing.TB) *Options {
+	return getOptionsOf(t, []base.Subnet{
+		{Role: "staff", IpStart: "192.0.2.10", IpStop: "192.0.2.20", Netmask: "255.255.255.0", LeaseTime: "3600s"},
+		{Role: "guest", IpStart: "198.51.100.10", IpStop: "198.51.100.20", Netmask: "255.255.255.0", LeaseTime: "600s"},
+		{Role: "boss", IpStart: "203.0.113.10", IpStop: "203.0.113.20", Netmask: "255.255.255.0", LeaseTime: "3600s"},
+	})
+}
+
+// getOptionsOf sets up the roles with a lease file in a temp dir
+func getOptionsOf(t testing.TB, roles []base.Subnet) *Options {
+	conf := &base.Config{ServerId: "192.0.2.1", Roles: roles}
+	o := &Options{conf: conf, records: newLeaseIndex()}
+	if err := o.setupRoles(conf.Roles); err != nil {
+		t.Fatal(err)
+	}
+	leases, err := textfile.Open(filepath.Join(t.TempDir(), "lease.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { leases.Close() })
+	o.leases = leases
+	o.commits = newCommitter(leases)
+	t.Cleanup(o.commits.close)
+	o.probes = make(chan struct{}, maxProbing)
+	o.probingKeys = make(map[string]bool)
+	o.quarantine = make(map[string]*Quarantine)
+	o.quarantineTime = defaultQuarantineTime
+	o.offerTime = defaultOfferTime
+	o.leaseGrace = defaultLeaseGrace
+	o.assigned = make(map[string]string)
+	o.audit = newAuditLog(ioutil.Discard)
+	return o
+}
+
+// record returns the lease of key, nil if there is none
+func record(o *Options, key string) *Record {
+	rec, _ := o.records.get(key)
+	return rec
+}
+
+func TestReap(t *testing.T) {
+	o := getOptions(t)
+	var events []EventType
+	o.Subscribe(func(ev Event) { events = append(events, ev.Type) })
+
+	ip, _ := o.roles[0].allocs[0].Allocate(net.IPNet{})
+	now := time.Now()
+	mac := "00:00:00:00:00:01"
+	o.records.add(&Record{IP: ip.IP, mac: mac, expires: now.Add(time.Minute), role: "staff", state: leaseBound})
+
+	o.reap(now)
+	if record(o, mac).state != leaseBound || len(events) != 0 {
+		t.Fatal("lease expired before its time")
+	}
+
+	o.reap(now.Add(2 * time.Minute))
+	if record(o, mac).state != leaseExpired {
+		t.Fatalf("state %v, want %v", record(o, mac).state, leaseExpired)
+	}
+	// IP is still held in the grace period
+	if next, _ := o.roles[0].allocs[0].Allocate(net.IPNet{IP: ip.IP}); next.IP.Equal(ip.IP) {
+		t.Fatal("expired IP allocated in the grace period")
+	}
+
+	o.reap(now.Add(time.Minute + o.leaseGrace))
+	if _, ok := o.records.get(mac); ok {
+		t.Fatal("lease not reclaimed after the grace period")
+	}
+	if next, _ := o.roles[0].allocs[0].Allocate(net.IPNet{IP: ip.IP}); !next.IP.Equal(ip.IP) {
+		t.Fatal("reclaimed IP not back in the allocator")
+	}
+	if len(events) != 2 || events[0] != EventLeaseExpired || events[1] != EventLeaseReclaimed {
+		t.Fatalf("events %v", events)
+	}
+}
+
+func TestReapReleased(t *testing.T) {
+	o := getOptions(t)
+	now := time.Now()
+	o.records.add(&Record{IP: net.IPv4(192, 0, 2, 10), mac: "00:00:00:00:00:01", expires: now, role: "staff", state: leaseReleased})
+	o.records.add(&Record{IP: net.IPv4(192, 0, 2, 11), mac: "00:00:00:00:00:02", expires: now, role: "staff", state: leaseDeclined})
+
+	o.reap(now.Add(time.Minute))
+	if o.records.len() != 2 {
+		t.Fatal("record dropped in the grace period")
+	}
+	o.reap(now.Add(o.leaseGrace))
+	if n := o.records.len(); n != 0 {
+		t.Fatalf("%d released or declined records left after the grace period", n)
+	}
+}
+
+func TestDecline(t *testing.T) {
+	o := getOptions(t)
+	mac := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	ip, err := lease(o, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decline, _ := dhcpv4.New(dhcpv4.WithHwAddr(mac), dhcpv4.WithMessageType(dhcpv4.MessageTypeDecline),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)), dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(192, 0, 2, 1))))
+	resp, _ := dhcpv4.NewReplyFromRequest(decline)
+	if o.Handle(context.Background(), "eth0", decline, resp) {
+		t.Fatal("DECLINE answered")
+	}
+	qs := o.Quarantined()
+	if len(qs) != 1 || !qs[0].IP.Equal(ip) || qs[0].Reason != "declined" {
+		t.Fatalf("quarantine %+v, want %s declined", qs, ip)
+	}
+	if rec := record(o, mac.String()); rec == nil || rec.state != leaseDeclined {
+		t.Fatalf("record %+v, want declined", rec)
+	}
+
+	// the client starts over and gets another IP
+	discover, _ := dhcpv4.NewDiscovery(mac)
+	offer, _ := dhcpv4.NewReplyFromRequest(discover)
+	if !o.Handle(context.Background(), "eth0", discover, offer) || offer.YourIPAddr.Equal(ip) {
+		t.Fatalf("offer %s after declining %s", offer.YourIPAddr, ip)
+	}
+
+	o.expireQuarantine(time.Now().Add(o.quarantineTime + time.Second))
+	if qs := o.Quarantined(); len(qs) != 0 {
+		t.Fatalf("quarantine %+v after it's over", qs)
+	}
+	if err := o.roles[0].reserve(ip); err != nil {
+		t.Fatalf("declined IP %s not back in the pool: %v", ip, err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	o := getOptions(t)
+	mac := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	ip, err := lease(o, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a RELEASE of another IP than the leased one is ignored
+	release, _ := dhcpv4.New(dhcpv4.WithHwAddr(mac), dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+		dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 19)), dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(192, 0, 2, 1))))
+	resp, _ := dhcpv4.NewReplyFromRequest(release)
+	o.Handle(context.Background(), "eth0", release, resp)
+	if rec := record(o, mac.String()); rec == nil || rec.state != leaseBound {
+		t.Fatalf("record %+v after the RELEASE of another IP", rec)
+	}
+
+	release.ClientIPAddr = ip
+	if o.Handle(context.Background(), "eth0", release, resp) {
+		t.Fatal("RELEASE answered")
+	}
+	if rec := record(o, mac.String()); rec == nil || rec.state != leaseReleased {
+		t.Fatalf("record %+v, want released", rec)
+	}
+	if err := o.roles[0].reserve(ip); err != nil {
+		t.Fatalf("released IP %s not back in the pool: %v", ip, err)
+	}
+	o.roles[0].free(ip)
+
+	// the lease file is written in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		l, err := o.leases.Get(mac.String())
+		if err == nil && l.State == leaseReleased.String() && l.IP.Equal(ip) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stored lease %+v %v, want released", l, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInform(t *testing.T) {
+	o := getOptionsOf(t, []base.Subnet{
+		{Role: "staff", IpStart: "192.0.2.10", IpStop: "192.0.2.20", Netmask: "255.255.255.0", LeaseTime: "3600s",
+			Router: "192.0.2.1", Dns: "192.0.2.2"},
+		{Role: "guest", IpStart: "198.51.100.10", IpStop: "198.51.100.20", Netmask: "255.255.255.128", LeaseTime: "600s",
+			Router: "198.51.100.1", Dns: "198.51.100.2"},
+	})
+	// a static IP on the guest network, the client would be staff otherwise
+	inform, _ := dhcpv4.New(dhcpv4.WithHwAddr(net.HardwareAddr{0, 0, 0, 0, 0, 1}), dhcpv4.WithMessageType(dhcpv4.MessageTypeInform),
+		dhcpv4.WithClientIP(net.IPv4(198, 51, 100, 50)))
+	ack, _ := dhcpv4.NewReplyFromRequest(inform)
+	if !o.Handle(context.Background(), "eth0", inform, ack) {
+		t.Fatal("INFORM not answered")
+	}
+	if !ack.YourIPAddr.IsUnspecified() {
+		t.Fatalf("yiaddr %s, want 0.0.0.0", ack.YourIPAddr)
+	}
+	for _, opt := range []dhcpv4.OptionCode{dhcpv4.OptionIPAddressLeaseTime, dhcpv4.OptionRenewTimeValue, dhcpv4.OptionRebindingTimeValue} {
+		if ack.Options.Has(opt) {
+			t.Fatalf("option %v in the ACK of an INFORM", opt)
+		}
+	}
+	if mask := net.IP(ack.SubnetMask()); !mask.Equal(net.IPv4(255, 255, 255, 128)) {
+		t.Fatalf("subnet mask %s, want the guest one", mask)
+	}
+	if r := ack.Router(); len(r) != 1 || !r[0].Equal(net.IPv4(198, 51, 100, 1)) {
+		t.Fatalf("router %v, want the guest one", r)
+	}
+	if dns := ack.DNS(); len(dns) != 1 || !dns[0].Equal(net.IPv4(198, 51, 100, 2)) {
+		t.Fatalf("dns %v, want the guest one", dns)
+	}
+	if record(o, "00:00:00:00:00:01") != nil {
+		t.Fatal("INFORM got a lease")
+	}
+}
+
+func TestReserveRecords(t *testing.T) {
+	o := getOptions(t)
+	now := time.Now()
+	records := map[string]*Record{
+		"00:00:00:00:00:01": {IP: net.IPv4(192, 0, 2, 10), expires: now.Add(time.Hour), role: "staff", state: leaseBound},
+		// older lease of the same IP loses it
+		"00:00:00:00:00:02": {IP: net.IPv4(192, 0, 2, 10), expires: now.Add(time.Minute), role: "staff", state: leaseBound},
+		// out of the staff range
+		"00:00:00:00:00:03": {IP: net.IPv4(192, 0, 2, 100), expires: now.Add(time.Hour), role: "staff", state: leaseBound},
+		// role is gone
+		"00:00:00:00:00:04": {IP: net.IPv4(192, 0, 2, 11), expires: now.Add(time.Hour), role: "lab", state: leaseBound},
+		"00:00:00:00:00:05": {IP: net.IPv4(198, 51, 100, 10), expires: now.Add(time.Hour), role: "guest", state: leaseBound},
+		// already over, not reserved
+		"00:00:00:00:00:06": {IP: net.IPv4(192, 0, 2, 12), expires: now.Add(-time.Hour), role: "staff", state: leaseExpired},
+	}
+	o.reserveRecords(records)
+
+	for _, mac := range []string{"00:00:00:00:00:01", "00:00:00:00:00:05"} {
+		if rec, ok := records[mac]; !ok || rec.state != leaseBound {
+			t.Errorf("%s: lease not kept", mac)
+		}
+	}
+	if len(records) != 2 {
+		t.Errorf("%d leases kept, want 2", len(records))
+	}
+
+	// reserved IPs are not handed out again
+	for i := 0; i < 10; i++ {
+		ip, err := o.roles[0].allocs[0].Allocate(net.IPNet{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.IP.Equal(net.IPv4(192, 0, 2, 10)) {
+			t.Fatalf("reserved IP %s allocated again", ip.IP)
+		}
+	}
+	ip, _ := o.roles[1].allocs[0].Allocate(net.IPNet{IP: net.IPv4(198, 51, 100, 10)})
+	if ip.IP.Equal(net.IPv4(198, 51, 100, 10)) {
+		t.Fatalf("reserved IP %s allocated again", ip.IP)
+	}
+}
+
+func TestNewWithHosts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lease.txt")
+	leases, err := textfile.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	for _, l := range []*leasestore.Lease{
+		// the reserved client on the reserved IP, and on another one before
+		{Mac: "00:1a:6d:38:15:ff", IP: net.IPv4(192, 0, 2, 5), Expires: expires, Role: "staff", State: "bound"},
+		{Mac: "00:1a:6d:38:15:fe", ClientId: "01001a6d3815fe", IP: net.IPv4(192, 0, 2, 12), Expires: expires, Role: "staff", State: "bound"},
+		{Mac: "00:00:00:00:00:01", IP: net.IPv4(192, 0, 2, 10), Expires: expires, Role: "staff", State: "bound"},
+	} {
+		if err := leases.Put(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leases.Close()
+
+	o, err := New(&base.Config{
+		LeasePath: path,
+		AuditLog:  filepath.Join(dir, "audit.log"),
+		Roles: []base.Subnet{{Role: "staff", IpStart: "192.0.2.10", IpStop: "192.0.2.20", Netmask: "255.255.255.0", LeaseTime: "3600s",
+			Hosts: []base.Host{
+				{Mac: "00:1a:6d:38:15:ff", Ip: "192.0.2.5"},
+				{ClientId: "01:00:1a:6d:38:15:fe", Ip: "192.0.2.6"},
+			}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if len(o.Reservations()) != 2 {
+		t.Fatalf("reservations %+v", o.Reservations())
+	}
+	for key, want := range map[string]net.IP{
+		"00:1a:6d:38:15:ff": net.IPv4(192, 0, 2, 5),
+		"00:00:00:00:00:01": net.IPv4(192, 0, 2, 10),
+		// not the reserved IP, dropped
+		"id:01001a6d3815fe": nil,
+	} {
+		rec := record(o, key)
+		if (rec == nil) != (want == nil) || (rec != nil && !rec.IP.Equal(want)) {
+			t.Fatalf("lease of %s: %+v, want %v", key, rec, want)
+		}
+	}
+}
+
+func TestOverlappingRoles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &base.Config{
+		LeasePath: filepath.Join(dir, "lease.txt"),
+		AuditLog:  filepath.Join(dir, "audit.log"),
+		Roles: []base.Subnet{
+			{Role: "staff", IpStart: "10.0.0.100", IpStop: "10.0.0.200", Netmask: "255.255.255.0", LeaseTime: "60s"},
+			{Role: "boss", Pools: []base.Pool{{IpStart: "10.0.0.20", IpStop: "10.0.0.30"}, {IpStart: "10.0.0.200", IpStop: "10.0.0.210"}},
+				Netmask: "255.255.255.0", LeaseTime: "60s"},
+		},
+	}
+	if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), "overlaps") {
+		t.Fatalf("overlapping pools: %v", err)
+	}
+	cfg.Roles[1].Pools[1] = base.Pool{IpStart: "10.0.0.201", IpStop: "10.0.0.210"}
+	o, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+}
+
+func TestRolePools(t *testing.T) {
+	r, err := newRole(base.Subnet{
+		Role:      "iot",
+		Pools:     []base.Pool{{IpStart: "10.0.0.10", IpStop: "10.0.0.11"}, {IpStart: "10.0.0.20", IpStop: "10.0.0.21"}},
+		Netmask:   "255.255.255.0",
+		LeaseTime: "60s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.subnetContains(net.IPv4(10, 0, 0, 200)) || r.subnetContains(net.IPv4(10, 0, 1, 10)) {
+		t.Fatal("subnetContains")
+	}
+	if ip, err := r.allocate(net.IPv4(10, 0, 0, 21)); err != nil || !ip.Equal(net.IPv4(10, 0, 0, 21)) {
+		t.Fatalf("hint in the second pool: %v %v", ip, err)
+	}
+	// the first pool is used up before the second one
+	for _, want := range []net.IP{net.IPv4(10, 0, 0, 10), net.IPv4(10, 0, 0, 11), net.IPv4(10, 0, 0, 20)} {
+		if ip, err := r.allocate(nil); err != nil || !ip.Equal(want) {
+			t.Fatalf("allocate: %v %v, want %v", ip, err, want)
+		}
+	}
+	if _, err := r.allocate(nil); err == nil {
+		t.Fatal("allocate from full pools")
+	}
+	if err := r.free(net.IPv4(10, 0, 0, 11)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reserve(net.IPv4(10, 0, 0, 11)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reserve(net.IPv4(10, 0, 0, 15)); err == nil {
+		t.Fatal("reserve out of the pools")
+	}
+}
+
+func TestRoleLookup(t *testing.T) {
+	o := getOptions(t)
+	mac, _ := net.ParseMAC("00:00:00:00:00:01")
+	discover, _ := dhcpv4.NewDiscovery(mac)
+
+	// lookup doesn't know the MAC yet
+	role := ""
+	o.SetRoleLookup(func(string) string { return role })
+	if idx := o.findSubnetIndex(discover, "eth0"); idx != o.fallback {
+		t.Fatalf("role %d, want the fallback %d", idx, o.fallback)
+	}
+	resp, _ := dhcpv4.NewReplyFromRequest(discover)
+	if !o.Handle(context.Background(), "eth0", discover, resp) || !o.roles[0].rangeContains(resp.YourIPAddr) {
+		t.Fatalf("offer %s from the fallback role", resp.YourIPAddr)
+	}
+
+	// answer came in before the next DISCOVER, offer again from the right role
+	role = "guest"
+	resp, _ = dhcpv4.NewReplyFromRequest(discover)
+	if !o.Handle(context.Background(), "eth0", discover, resp) || !o.roles[1].rangeContains(resp.YourIPAddr) {
+		t.Fatalf("offer %s from the guest role", resp.YourIPAddr)
+	}
+	if next, _ := o.roles[0].allocate(nil); !next.Equal(net.IPv4(192, 0, 2, 10)) {
+		t.Fatalf("first offer not freed, got %s", next)
+	}
+
+	// the unknown role falls back
+	role = "nosuchrole"
+	other, _ := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0, 0, 0, 0, 2})
+	if idx := o.findSubnetIndex(other, "eth0"); idx != o.fallback {
+		t.Fatalf("role %d, want the fallback %d", idx, o.fallback)
+	}
+}
+
+func TestRules(t *testing.T) {
+	o := getOptions(t)
+	o.conf.Rules = []base.Rule{
+		{Name: "printers", Role: "guest", Mac: "00:1A:2B"},
+		{Name: "phones", Role: "boss", VendorClass: "Polycom*", Priority: 10},
+		{Name: "lab", Role: "guest", UserClass: "lab", Iface: "eth1"},
+		{Name: "port1", Role: "boss", CircuitId: "eth0/1", RemoteId: "switch1"},
+	}
+	if err := o.setupRules(o.conf.Rules); err != nil {
+		t.Fatal(err)
+	}
+	o.SetRoleLookup(func(string) string { return "guest" })
+
+	tests := []struct {
+		name   string
+		mac    string
+		ifname string
+		mods   []dhcpv4.Modifier
+		role   string
+		reason string
+	}{
+		{"oui", "00:1a:2b:00:00:01", "eth0", nil, "guest", "rule printers"},
+		{"priority", "00:1a:2b:00:00:02", "eth0", []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptClassIdentifier("polycom-vvx"))}, "boss", "rule phones"},
+		{"user class and iface", "00:00:00:00:00:03", "eth1", []dhcpv4.Modifier{dhcpv4.WithUserClass("lab", false)}, "guest", "rule lab"},
+		{"wrong iface", "00:00:00:00:00:04", "eth0", []dhcpv4.Modifier{dhcpv4.WithUserClass("lab", false)}, "guest", "control center"},
+		{"relay agent", "00:00:00:00:00:05", "eth0", []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(
+			dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth0/1")),
+			dhcpv4.OptGeneric(dhcpv4.AgentRemoteIDSubOption, []byte("switch1")),
+		))}, "boss", "rule port1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mac, _ := net.ParseMAC(tt.mac)
+			req, err := dhcpv4.NewDiscovery(mac, tt.mods...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx, reason := o.classify(req, newClient(req, tt.ifname))
+			if o.roles[idx].name != tt.role || reason != tt.reason {
+				t.Fatalf("role %s by %s, want %s by %s", o.roles[idx].name, reason, tt.role, tt.reason)
+			}
+		})
+	}
+
+	o.conf.Rules = append(o.conf.Rules, base.Rule{Name: "bad", Role: "nosuchrole"})
+	if err := o.setupRules(o.conf.Rules); err == nil {
+		t.Fatal("rule with an unknown role")
+	}
+}
+
+func TestSetRole(t *testing.T) {
+	o := getOptions(t)
+	var audit bytes.Buffer
+	o.audit.SetOutput(&audit)
+	var events []Event
+	o.Subscribe(func(ev Event) { events = append(events, ev) })
+
+	mac, _ := net.ParseMAC("00:00:00:00:00:01")
+	o.conf.Rules = []base.Rule{{Name: "all", Role: "guest"}}
+	o.setupRules(o.conf.Rules)
+	discover, _ := dhcpv4.NewDiscovery(mac)
+	offer, _ := dhcpv4.NewReplyFromRequest(discover)
+	o.Handle(context.Background(), "eth0", discover, offer)
+	request, _ := dhcpv4.NewRequestFromOffer(offer)
+	ack, _ := dhcpv4.NewReplyFromRequest(request)
+	if !o.Handle(context.Background(), "eth0", request, ack) || record(o, mac.String()).state != leaseBound {
+		t.Fatal("lease not bound")
+	}
+	guestIP := ack.YourIPAddr
+
+	if err := o.SetRole("00:00:00:00:00:01", "staff", "test", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := o.records.get(mac.String()); ok {
+		t.Fatal("lease of the old role kept")
+	}
+	if ip, _ := o.roles[1].allocate(guestIP); !ip.Equal(guestIP) {
+		t.Fatalf("IP %s of the old role not freed", guestIP)
+	}
+	if len(events) != 2 || events[0].Type != EventRoleChanged || events[1].Type != EventForceRenew || !events[1].IP.Equal(guestIP) {
+		t.Fatalf("events: %+v", events)
+	}
+	if !bytes.Contains(audit.Bytes(), []byte(`"from":"guest"`)) || !bytes.Contains(audit.Bytes(), []byte(`"to":"staff"`)) {
+		t.Fatalf("audit: %s", audit.String())
+	}
+
+	// RENEW is NAKed, the client DISCOVERs into the staff pool
+	renew, _ := dhcpv4.New(dhcpv4.WithHwAddr(mac), dhcpv4.WithClientIP(guestIP), dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest))
+	nak, _ := dhcpv4.NewReplyFromRequest(renew)
+	if !o.Handle(context.Background(), "eth0", renew, nak) || nak.MessageType() != dhcpv4.MessageTypeNak {
+		t.Fatalf("RENEW got %v, want NAK", nak.MessageType())
+	}
+	offer, _ = dhcpv4.NewReplyFromRequest(discover)
+	if !o.Handle(context.Background(), "eth0", discover, offer) || !o.roles[0].rangeContains(offer.YourIPAddr) {
+		t.Fatalf("offer %s not from the staff pool", offer.YourIPAddr)
+	}
+
+	if err := o.SetRole("00:00:00:00:00:01", "nosuchrole", "test", false); err == nil {
+		t.Fatal("unknown role accepted")
+	}
+
+	// the role is kept in the config, it's set again on the next start
+	if role := o.conf.Assignments[mac.String()]; role != "staff" {
+		t.Fatalf("assignment in the config: %q", role)
+	}
+	o.assigned = nil
+	if err := o.setupAssigned(); err != nil || o.assigned[mac.String()] != "staff" {
+		t.Fatalf("assignments %v %v", o.assigned, err)
+	}
+	o.conf.Assignments["00:00:00:00:00:02"] = "nosuchrole"
+	if err := o.setupAssigned(); err == nil {
+		t.Fatal("assignment to an unknown role loaded")
+	}
+}
+
+func TestReservation(t *testing.T) {
+	o := getOptions(t)
+	mac, _ := net.ParseMAC("00:00:00:00:00:01")
+	if err := o.AddReservation("", base.Host{Mac: "00:00:00:00:00:01", Ip: "198.51.100.10", Hostname: "printer", Router: "198.51.100.254", LeaseTime: "24h"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []base.Host{
+		{Mac: "00:00:00:00:00:02", Ip: "198.51.100.10"}, // taken
+		{Mac: "00:00:00:00:00:01", Ip: "198.51.100.11"}, // already reserved
+		{Mac: "00:00:00:00:00:03", Ip: "192.0.2.10"},    // not on the guest network
+		{Ip: "198.51.100.12"},                           // no client
+		{ClientId: "zz", Ip: "198.51.100.12"},           // bad client-id
+	} {
+		if err := o.AddReservation("guest", h); err == nil {
+			t.Fatalf("reservation %+v accepted", h)
+		}
+	}
+
+	// the reserved IP is out of the dynamic pool
+	for i := 0; i < 10; i++ {
+		if ip, err := o.roles[1].allocate(nil); err == nil && ip.Equal(net.IPv4(198, 51, 100, 10)) {
+			t.Fatal("reserved IP allocated")
+		}
+	}
+
+	discover, _ := dhcpv4.NewDiscovery(mac)
+	offer, _ := dhcpv4.NewReplyFromRequest(discover)
+	if !o.Handle(context.Background(), "eth0", discover, offer) || !offer.YourIPAddr.Equal(net.IPv4(198, 51, 100, 10)) {
+		t.Fatalf("offer %s, want the reserved IP", offer.YourIPAddr)
+	}
+	if offer.HostName() != "printer" || !offer.Router()[0].Equal(net.IPv4(198, 51, 100, 254)) || offer.IPAddressLeaseTime(0) != 24*time.Hour {
+		t.Fatalf("host options not applied: %s", offer.Summary())
+	}
+
+	// released reserved IP is not given back to the pool
+	record(o, mac.String()).setState(leaseBound)
+	release, _ := dhcpv4.New(dhcpv4.WithHwAddr(mac), dhcpv4.WithClientIP(offer.YourIPAddr), dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease))
+	o.Handle(context.Background(), "eth0", release, nil)
+	if err := o.roles[1].reserve(net.IPv4(198, 51, 100, 10)); err == nil {
+		t.Fatal("released reserved IP back in the pool")
+	}
+
+	if err := o.DeleteReservation("00:00:00:00:00:01", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.roles[1].reserve(net.IPv4(198, 51, 100, 10)); err != nil {
+		t.Fatalf("deleted reservation not back in the pool: %v", err)
+	}
+}
+
+func TestRequestedHint(t *testing.T) {
+	o := getOptions(t)
+	taken, _ := o.roles[0].allocate(net.IPv4(192, 0, 2, 15))
+
+	tests := []struct {
+		name string
+		mods []dhcpv4.Modifier
+		want net.IP
+	}{
+		{"option 50", []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 0, 2, 17)))}, net.IPv4(192, 0, 2, 17)},
+		{"ciaddr", []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 18))}, net.IPv4(192, 0, 2, 18)},
+		{"taken", []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(taken))}, nil},
+		{"out of the range", []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 0, 2, 100)))}, nil},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mac := net.HardwareAddr{0, 0, 0, 0, 0, byte(i + 1)}
+			discover, _ := dhcpv4.NewDiscovery(mac, tt.mods...)
+			offer, _ := dhcpv4.NewReplyFromRequest(discover)
+			if !o.Handle(context.Background(), "eth0", discover, offer) {
+				t.Fatal("no offer")
+			}
+			ip := offer.YourIPAddr
+			if tt.want != nil && !ip.Equal(tt.want) {
+				t.Fatalf("offer %s, want %s", ip, tt.want)
+			}
+			if tt.want == nil && (ip.Equal(taken) || !o.roles[0].rangeContains(ip)) {
+				t.Fatalf("offer %s", ip)
+			}
+		})
+	}
+}
+
+func TestClientIdLease(t *testing.T) {
+	o := getOptions(t)
+	id := dhcpv4.OptClientIdentifier([]byte{0xff, 0, 0, 0, 1})
+	mac1, _ := net.ParseMAC("00:00:00:00:00:01")
+	mac2, _ := net.ParseMAC("00:00:00:00:00:02")
+
+	discover, _ := dhcpv4.NewDiscovery(mac1, dhcpv4.WithOption(id))
+	offer, _ := dhcpv4.NewReplyFromRequest(discover)
+	if !o.Handle(context.Background(), "eth0", discover, offer) {
+		t.Fatal("no offer")
+	}
+	// the relay or the VM changed chaddr, the client-id is the same
+	request, _ := dhcpv4.NewRequestFromOffer(offer, dhcpv4.WithHwAddr(mac2), dhcpv4.WithOption(id))
+	ack, _ := dhcpv4.NewReplyFromRequest(request)
+	if !o.Handle(context.Background(), "eth0", request, ack) || ack.MessageType() == dhcpv4.MessageTypeNak || !ack.YourIPAddr.Equal(offer.YourIPAddr) {
+		t.Fatalf("REQUEST got %v %s, want %s", ack.MessageType(), ack.YourIPAddr, offer.YourIPAddr)
+	}
+	if _, ok := o.records.get(mac1.String()); ok {
+		t.Fatal("lease keyed by chaddr")
+	}
+
+	leases, err := o.Leases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 1 || leases[0].Mac != mac2.String() || leases[0].ClientId != "ff00000001" {
+		t.Fatalf("leases: %+v", leases)
+	}
+
+	// chaddr alone is another client
+	discover, _ = dhcpv4.NewDiscovery(mac2)
+	offer, _ = dhcpv4.NewReplyFromRequest(discover)
+	if !o.Handle(context.Background(), "eth0", discover, offer) || offer.YourIPAddr.Equal(ack.YourIPAddr) {
+		t.Fatalf("offer %s, leased to the client-id", offer.YourIPAddr)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	o := getOptions(t)
+	link := func(ip net.IP) dhcpv4.Modifier {
+		return dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(
+			dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("port1")),
+			dhcpv4.OptGeneric(dhcpv4.LinkSelectionSubOption, ip.To4()),
+		))
+	}
+
+	tests := []struct {
+		name string
+		mods []dhcpv4.Modifier
+		role int // -1 for no offer
+	}{
+		{"local", nil, 0},
+		{"giaddr", []dhcpv4.Modifier{dhcpv4.WithGatewayIP(net.IPv4(198, 51, 100, 1))}, 1},
+		{"link-selection", []dhcpv4.Modifier{dhcpv4.WithGatewayIP(net.IPv4(198, 51, 100, 1)), link(net.IPv4(203, 0, 113, 1))}, 2},
+		{"unknown network", []dhcpv4.Modifier{dhcpv4.WithGatewayIP(net.IPv4(10, 0, 0, 1))}, -1},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mac := net.HardwareAddr{0, 0, 0, 0, 0, byte(i + 1)}
+			discover, _ := dhcpv4.NewDiscovery(mac, tt.mods...)
+			offer, _ := dhcpv4.NewReplyFromRequest(discover)
+			ok := o.Handle(context.Background(), "eth0", discover, offer)
+			if tt.role < 0 {
+				if ok {
+					t.Fatalf("offer %s", offer.YourIPAddr)
+				}
+				return
+			}
+			if !ok || !o.roles[tt.role].rangeContains(offer.YourIPAddr) {
+				t.Fatalf("offer %s, want role %s", offer.YourIPAddr, o.roles[tt.role].name)
+			}
+			if discover.RelayAgentInfo() != nil && offer.RelayAgentInfo() == nil {
+				t.Fatal("option 82 not echoed")
+			}
+		})
+	}
+
+	// the client moved behind another relay, its lease is on the wrong network
+	mac := net.HardwareAddr{0, 0, 0, 0, 0, 2}
+	key := mac.String()
+	ip := record(o, key).IP
+	record(o, key).setState(leaseBound)
+	renew, _ := dhcpv4.New(dhcpv4.WithHwAddr(mac), dhcpv4.WithClientIP(ip), dhcpv4.WithGatewayIP(net.IPv4(192, 0, 2, 1)),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest))
+	nak, _ := dhcpv4.NewReplyFromRequest(renew)
+	if !o.Handle(context.Background(), "eth0", renew, nak) || nak.MessageType() != dhcpv4.MessageTypeNak {
+		t.Fatalf("RENEW got %v, want NAK", nak.MessageType())
+	}
+}
+
+func TestRenewOtherServer(t *testing.T) {
+	o := getOptions(t)
+	tests := []struct {
+		name   string
+		ciaddr net.IP
+		giaddr net.IP
+		nak    bool // false if ignored
+	}{
+		{"not our network", net.IPv4(10, 1, 1, 5), nil, false},
+		{"our network", net.IPv4(192, 0, 2, 15), nil, true},
+		{"not the network of the relay", net.IPv4(192, 0, 2, 15), net.IPv4(198, 51, 100, 1), false},
+		{"network of the relay", net.IPv4(198, 51, 100, 15), net.IPv4(198, 51, 100, 1), true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mods := []dhcpv4.Modifier{dhcpv4.WithHwAddr(net.HardwareAddr{0, 0, 0, 0, 1, byte(i)}), dhcpv4.WithClientIP(tt.ciaddr),
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest)}
+			if tt.giaddr != nil {
+				mods = append(mods, dhcpv4.WithGatewayIP(tt.giaddr))
+			}
+			renew, _ := dhcpv4.New(mods...)
+			resp, _ := dhcpv4.NewReplyFromRequest(renew)
+			ok := o.Handle(context.Background(), "eth0", renew, resp)
+			if ok != tt.nak || (ok && resp.MessageType() != dhcpv4.MessageTypeNak) {
+				t.Fatalf("answered %v with %v, want NAK %v", ok, resp.MessageType(), tt.nak)
+			}
+		})
+	}
+}
+
+// TestRequestStates checks the answer to a REQUEST in each client state of RFC 2131 4.3.2
+func TestRequestStates(t *testing.T) {
+	o := getOptions(t)
+	srvid := net.IPv4(192, 0, 2, 1)
+	bound := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	boundIP, err := lease(o, bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selecting := net.HardwareAddr{0, 0, 0, 0, 0, 2}
+	discover, _ := dhcpv4.NewDiscovery(selecting)
+	offer, _ := dhcpv4.NewReplyFromRequest(discover)
+	if !o.Handle(context.Background(), "eth0", discover, offer) {
+		t.Fatal("no offer")
+	}
+	offeredIP := offer.YourIPAddr
+	other := net.IPv4(192, 0, 2, 19)
+
+	const (
+		ack = iota
+		nak
+		ignore
+	)
+	tests := []struct {
+		name string
+		mods []dhcpv4.Modifier
+		want int
+	}{
+		{"selecting another server", []dhcpv4.Modifier{dhcpv4.WithHwAddr(selecting),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(192, 0, 2, 2))), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(offeredIP))}, ignore},
+		{"selecting an IP not offered", []dhcpv4.Modifier{dhcpv4.WithHwAddr(selecting),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(srvid)), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(other))}, nak},
+		{"selecting the offer", []dhcpv4.Modifier{dhcpv4.WithHwAddr(selecting),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(srvid)), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(offeredIP))}, ack},
+		{"init-reboot on the wrong network", []dhcpv4.Modifier{dhcpv4.WithHwAddr(bound),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 1, 1, 5)))}, nak},
+		{"init-reboot without a lease", []dhcpv4.Modifier{dhcpv4.WithHwAddr(net.HardwareAddr{0, 0, 0, 0, 0, 3}),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(other))}, ignore},
+		{"init-reboot with another IP", []dhcpv4.Modifier{dhcpv4.WithHwAddr(bound),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(other))}, nak},
+		{"init-reboot with the leased IP", []dhcpv4.Modifier{dhcpv4.WithHwAddr(bound),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(boundIP))}, ack},
+		{"renewing another IP", []dhcpv4.Modifier{dhcpv4.WithHwAddr(bound), dhcpv4.WithClientIP(other)}, nak},
+		{"renewing the leased IP", []dhcpv4.Modifier{dhcpv4.WithHwAddr(bound), dhcpv4.WithClientIP(boundIP)}, ack},
+		{"rebinding off the network", []dhcpv4.Modifier{dhcpv4.WithHwAddr(net.HardwareAddr{0, 0, 0, 0, 0, 3}),
+			dhcpv4.WithClientIP(net.IPv4(10, 1, 1, 5)), dhcpv4.WithBroadcast(true)}, ignore},
+		{"rebinding another IP", []dhcpv4.Modifier{dhcpv4.WithHwAddr(bound), dhcpv4.WithClientIP(other), dhcpv4.WithBroadcast(true)}, nak},
+		{"rebinding the leased IP", []dhcpv4.Modifier{dhcpv4.WithHwAddr(bound), dhcpv4.WithClientIP(boundIP), dhcpv4.WithBroadcast(true)}, ack},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := dhcpv4.New(append(tt.mods, dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest))...)
+			resp, _ := dhcpv4.NewReplyFromRequest(req)
+			got := ignore
+			if o.Handle(context.Background(), "eth0", req, resp) {
+				got = ack
+				if resp.MessageType() == dhcpv4.MessageTypeNak {
+					got = nak
+				}
+			}
+			if got != tt.want {
+				t.Fatalf("got %d, want %d (0 ACK, 1 NAK, 2 ignored)", got, tt.want)
+			}
+			if got == nak && !resp.YourIPAddr.IsUnspecified() {
+				t.Fatalf("NAK with yiaddr %s", resp.YourIPAddr)
+			}
+		})
+	}
+}
+
+func TestIfaces(t *testing.T) {
+	o := getOptions(t)
+	o.conf.Interfaces = []base.Interface{
+		{Name: "eth1", Roles: []string{"staff", "boss"}},
+		{Name: "eth2", Roles: []string{"guest"}, ServerId: "198.51.100.1"},
+	}
+	if err := o.setupIfaces(); err != nil {
+		t.Fatal(err)
+	}
+	o.conf.Rules = []base.Rule{{Name: "all", Role: "boss"}}
+	o.setupRules(o.conf.Rules)
+
+	tests := []struct {
+		ifname   string
+		role     int
+		serverId net.IP
+	}{
+		{"eth1", 2, net.IPv4(192, 0, 2, 1)},
+		{"eth2", 1, net.IPv4(198, 51, 100, 1)},
+	}
+	for i, tt := range tests {
+		t.Run(tt.ifname, func(t *testing.T) {
+			mac := net.HardwareAddr{0, 0, 0, 0, 0, byte(i + 1)}
+			discover, _ := dhcpv4.NewDiscovery(mac)
+			offer, _ := dhcpv4.NewReplyFromRequest(discover)
+			if !o.Handle(context.Background(), tt.ifname, discover, offer) || !o.roles[tt.role].rangeContains(offer.YourIPAddr) {
+				t.Fatalf("offer %s, want role %s", offer.YourIPAddr, o.roles[tt.role].name)
+			}
+			if !offer.ServerIdentifier().Equal(tt.serverId) {
+				t.Fatalf("server id %s, want %s", offer.ServerIdentifier(), tt.serverId)
+			}
+		})
+	}
+
+	// selecting the server id of eth2 is not for eth1
+	mac := net.HardwareAddr{0, 0, 0, 0, 0, 2}
+	discover, _ := dhcpv4.NewDiscovery(mac)
+	offer, _ := dhcpv4.NewReplyFromRequest(discover)
+	o.Handle(context.Background(), "eth2", discover, offer)
+	request, _ := dhcpv4.NewRequestFromOffer(offer)
+	ack, _ := dhcpv4.NewReplyFromRequest(request)
+	if o.Handle(context.Background(), "eth1", request, ack) {
+		t.Fatal("REQUEST for eth2 answered on eth1")
+	}
+
+	o.conf.Interfaces = []base.Interface{{Name: "eth1", Roles: []string{"nosuchrole"}}}
+	if err := o.setupIfaces(); err == nil {
+		t.Fatal("unknown role accepted")
+	}
+}
+
+// fakeProber answers for the IPs in use, probed counts the probes
+type fakeProber struct {
+	sync.Mutex
+	inUse  map[string]bool
+	probed int
+}
+
+func (p *fakeProber) Probe(ctx context.Context, ip net.IP) (bool, error) {
+	p.Lock()
+	defer p.Unlock()
+	p.probed++
+	return p.inUse[ip.String()], nil
+}
+
+func TestProbe(t *testing.T) {
+	o := getOptions(t)
+	p := &fakeProber{inUse: map[string]bool{"192.0.2.10": true, "192.0.2.11": true}}
+	o.SetProber(p)
+
+	mac, _ := net.ParseMAC("00:00:00:00:00:01")
+	discover, _ := dhcpv4.NewDiscovery(mac)
+	offer, _ := dhcpv4.NewReplyFromRequest(discover)
+	if !o.Handle(context.Background(), "eth0", discover, offer) {
+		t.Fatal("no offer")
+	}
+	if ip := offer.YourIPAddr; p.inUse[ip.String()] || !o.roles[0].rangeContains(ip) {
+		t.Fatalf("offer %s", ip)
+	}
+	if p.probed != 3 {
+		t.Fatalf("probed %d IPs, want 3", p.probed)
+	}
+	qs := o.Quarantined()
+	if len(qs) != 2 || qs[0].Reason != "abandoned" {
+		t.Fatalf("quarantine: %+v", qs)
+	}
+
+	// the retransmission gets the same offer, it's probed already
+	offer2, _ := dhcpv4.NewReplyFromRequest(discover)
+	if !o.Handle(context.Background(), "eth0", discover, offer2) || !offer2.YourIPAddr.Equal(offer.YourIPAddr) || p.probed != 3 {
+		t.Fatalf("offer %s, probed %d", offer2.YourIPAddr, p.probed)
+	}
+
+	// every IP answers, the DISCOVER stays unanswered
+	for i := 12; i <= 20; i++ {
+		p.inUse[fmt.Sprintf("192.0.2.%d", i)] = true
+	}
+	discover, _ = dhcpv4.NewDiscovery(net.HardwareAddr{0, 0, 0, 0, 0, 2})
+	offer, _ = dhcpv4.NewReplyFromRequest(discover)
+	if o.Handle(context.Background(), "eth0", discover, offer) {
+		t.Fatalf("offer %s in use", offer.YourIPAddr)
+	}
+}
+
+// slowProber answers once released, for the IPs in use
+type slowProber struct {
+	fakeProber
+	release chan struct{}
+}
+
+func (p *slowProber) Probe(ctx context.Context, ip net.IP) (bool, error) {
+	<-p.release
+	return p.fakeProber.Probe(ctx, ip)
+}
+
+func TestProbeLater(t *testing.T) {
+	o := getOptions(t)
+	p := &slowProber{fakeProber: fakeProber{inUse: map[string]bool{"192.0.2.10": true}}, release: make(chan struct{})}
+	o.SetProber(p)
+
+	offers := make(chan *dhcpv4.DHCPv4, 4)
+	later := func(resp *dhcpv4.DHCPv4) { offers <- resp }
+	discover, _ := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0, 0, 0, 0, 1})
+	handle := func() bool {
+		resp, _ := dhcpv4.NewReplyFromRequest(discover)
+		return o.HandleLater(context.Background(), "eth0", discover, resp, later)
+	}
+	// the worker doesn't wait for the probe, nor the retransmission
+	if handle() || handle() {
+		t.Fatal("offer sent before the IP was probed")
+	}
+	close(p.release)
+	select {
+	case offer := <-offers:
+		if !offer.YourIPAddr.Equal(net.IPv4(192, 0, 2, 11)) || !offer.ServerIdentifier().Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Fatalf("offer %s from %s, want 192.0.2.11 after 192.0.2.10 was abandoned", offer.YourIPAddr, offer.ServerIdentifier())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no offer once the IP was probed")
+	}
+	o.probing.Wait()
+	if len(offers) != 0 || p.probed != 2 {
+		t.Fatalf("%d more offers, probed %d, want one probe per IP", len(offers), p.probed)
+	}
+	// probed already, answered right away
+	if !handle() {
+		t.Fatal("retransmission not answered")
+	}
+
+	// the background probes are all busy, the IP is offered unprobed
+	for i := 0; i < maxProbing; i++ {
+		o.probes <- struct{}{}
+	}
+	discover, _ = dhcpv4.NewDiscovery(net.HardwareAddr{0, 0, 0, 0, 0, 2})
+	if !handle() || p.probed != 2 {
+		t.Fatalf("no offer with the probes busy, probed %d", p.probed)
+	}
+	for i := 0; i < maxProbing; i++ {
+		<-o.probes
+	}
+}
+
+func TestProbeAbandon(t *testing.T) {
+	o := getOptions(t)
+	o.SetProber(&fakeProber{inUse: map[string]bool{"192.0.2.10": true}})
+	lim, err := newLimiter(base.RateLimit{Client: "1/1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.roles[0].limiter = lim
+
+	mac := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	discover, _ := dhcpv4.NewDiscovery(mac)
+	handle := func() bool {
+		resp, _ := dhcpv4.NewReplyFromRequest(discover)
+		return o.Handle(context.Background(), "eth0", discover, resp)
+	}
+	// the IP offered after the abandoned one is charged with the DISCOVER
+	if !handle() {
+		t.Fatal("no offer after an IP in use")
+	}
+	if rec := record(o, mac.String()); rec.state != leaseOffered || !rec.IP.Equal(net.IPv4(192, 0, 2, 11)) {
+		t.Fatalf("record %+v", rec)
+	}
+	qs := o.Quarantined()
+	if len(qs) != 1 || !qs[0].IP.Equal(net.IPv4(192, 0, 2, 10)) {
+		t.Fatalf("quarantine %+v", qs)
+	}
+
+	// a new DISCOVER is over the client limit
+	o.records.remove(mac.String())
+	discover, _ = dhcpv4.NewDiscovery(mac)
+	if handle() {
+		t.Fatal("client limit not applied")
+	}
+
+	// the abandoned offer is forgotten once it expires
+	mac2 := net.HardwareAddr{0, 0, 0, 0, 0, 2}
+	o.records.add(&Record{IP: net.IPv4(192, 0, 2, 15), mac: mac2.String(), expires: time.Now(), role: "staff", state: leaseAbandoned})
+	o.expireOffers(time.Now().Add(time.Second))
+	if record(o, mac2.String()) != nil {
+		t.Fatal("abandoned offer kept after it expired")
+	}
+}
+
+func TestHandleDone(t *testing.T) {
+	o := getOptions(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mac := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	discover, _ := dhcpv4.NewDiscovery(mac)
+	offer, _ := dhcpv4.NewReplyFromRequest(discover)
+	if o.Handle(ctx, "eth0", discover, offer) {
+		t.Fatalf("offer %s once ctx is done", offer.YourIPAddr)
+	}
+	if record(o, mac.String()) != nil {
+		t.Fatal("IP allocated once ctx is done")
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in    string
+		rate  float64
+		burst float64
+		err   bool
+	}{
+		{"", 0, 0, false},
+		{"10/1s", 10, 10, false},
+		{"30/1m", 0.5, 30, false},
+		{"10", 0, 0, true},
+		{"x/1m", 0, 0, true},
+		{"0/1m", 0, 0, true},
+		{"10/forever", 0, 0, true},
+	}
+	for _, tt := range tests {
+		l, err := parseLimit(tt.in)
+		if (err != nil) != tt.err {
+			t.Fatalf("%q: error %v", tt.in, err)
+		}
+		if l != nil && (l.rate != tt.rate || l.burst != tt.burst) {
+			t.Fatalf("%q: %+v", tt.in, l)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	o := getOptions(t)
+	var events []Event
+	o.Subscribe(func(ev Event) { events = append(events, ev) })
+	lim, err := newLimiter(base.RateLimit{Client: "1/1h", Relay: "2/1h", Role: "3/1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.roles[0].limiter = lim
+
+	discover := func(mac byte, mods ...dhcpv4.Modifier) bool {
+		req, _ := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0, 0, 0, 0, mac}, mods...)
+		resp, _ := dhcpv4.NewReplyFromRequest(req)
+		return o.Handle(context.Background(), "eth0", req, resp)
+	}
+	if !discover(1) || !discover(1) {
+		t.Fatal("no offer")
+	}
+	// the offer is lost, a new IP for the same MAC is over its limit
+	o.records.remove("00:00:00:00:00:01")
+	if discover(1) {
+		t.Fatal("client limit not applied")
+	}
+
+	relay := dhcpv4.WithGatewayIP(net.IPv4(192, 0, 2, 1))
+	if !discover(2, relay) || !discover(3, relay) || discover(4, relay) {
+		t.Fatal("relay limit not applied")
+	}
+	if len(events) != 0 {
+		t.Fatalf("events: %+v", events)
+	}
+	if discover(5) {
+		t.Fatal("role limit not applied")
+	}
+	if len(events) != 1 || events[0].Type != EventPoolDrain || events[0].Role != "staff" {
+		t.Fatalf("events: %+v", events)
+	}
+}
+
+// bigOptions has one role of a /16, so parallel clients don't run out of IPs
+func bigOptions(t testing.TB) *Options {
+	return getOptionsOf(t, []base.Subnet{
+		{Role: "staff", IpStart: "10.0.0.1", IpStop: "10.0.255.254", Netmask: "255.255.0.0", LeaseTime: "3600s"},
+	})
+}
+
+// lease runs DISCOVER and REQUEST for mac, it returns the acked IP
+func lease(o *Options, mac net.HardwareAddr) (net.IP, error) {
+	discover, _ := dhcpv4.NewDiscovery(mac)
+	offer, _ := dhcpv4.NewReplyFromRequest(discover)
+	if !o.Handle(context.Background(), "eth0", discover, offer) {
+		return nil, fmt.Errorf("no offer for %s", mac)
+	}
+	request, _ := dhcpv4.NewRequestFromOffer(offer)
+	ack, _ := dhcpv4.NewReplyFromRequest(request)
+	if !o.Handle(context.Background(), "eth0", request, ack) || ack.MessageType() == dhcpv4.MessageTypeNak {
+		return nil, fmt.Errorf("no ACK for %s", mac)
+	}
+	return ack.YourIPAddr, nil
+}
+
+// macOf returns a distinct MAC for every n
+func macOf(n uint32) net.HardwareAddr {
+	return net.HardwareAddr{2, 0, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+func TestParallelLeases(t *testing.T) {
+	// Run with -race to debug concurrency issues
+	o := bigOptions(t)
+	const clients, workers = 400, 16
+
+	var wg sync.WaitGroup
+	ips := make([]net.IP, clients)
+	errs := make(chan error, clients)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := w; n < clients; n += workers {
+				ip, err := lease(o, macOf(uint32(n)))
+				if err != nil {
+					errs <- err
+					return
+				}
+				ips[n] = ip
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for n, ip := range ips {
+		if seen[ip.String()] {
+			t.Fatalf("IP %s leased twice", ip)
+		}
+		seen[ip.String()] = true
+		if rec, ok := o.records.ofIP(ip); !ok || rec.mac != macOf(uint32(n)).String() {
+			t.Fatalf("IP %s not indexed to its client", ip)
+		}
+	}
+	// every ACK waited for its lease to be durable
+	leases, err := o.Leases()
+	if err != nil || len(leases) != clients {
+		t.Fatalf("%d leases stored, want %d: %v", len(leases), clients, err)
+	}
+}
+
+func TestLeaseAfterClose(t *testing.T) {
+	o := bigOptions(t)
+	// leases in flight while the committer closes fail, they don't panic
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := w; n < 200; n += 8 {
+				lease(o, macOf(uint32(n)))
+			}
+		}(w)
+	}
+	o.commits.close()
+	wg.Wait()
+
+	if _, err := lease(o, macOf(1000)); err == nil {
+		t.Fatal("ACK of a lease not persisted")
+	}
+	if err := o.dropRecord(macOf(1000).String()).wait(); err != errCommitterClosed {
+		t.Fatalf("drop after close: %v", err)
+	}
+}
+
+// Benchmark parallel DISCOVER, REQUEST and RELEASE of new clients, the lease file is
+// synced by every ACK and RELEASE, the concurrent ones share the sync
+func BenchmarkParallelLease(b *testing.B) {
+	// Run with -race to debug concurrency issues
+	o := bigOptions(b)
+	var next uint32
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mac := macOf(atomic.AddUint32(&next, 1))
+			ip, err := lease(o, mac)
+			if err != nil {
+				b.Log(err)
+				b.Fail()
+				continue
+			}
+			release, _ := dhcpv4.New(dhcpv4.WithHwAddr(mac), dhcpv4.WithClientIP(ip), dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease))
+			o.Handle(context.Background(), "eth0", release, nil)
+		}
+	})
+}
+
+// Benchmark parallel RENEW of bound leases, every ACK extends and syncs its lease
+func BenchmarkParallelRenew(b *testing.B) {
+	o := bigOptions(b)
+	const clients = 1024
+	ips := make([]net.IP, clients)
+	for n := range ips {
+		ip, err := lease(o, macOf(uint32(n)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		ips[n] = ip
+	}
+	var next uint32
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddUint32(&next, 1) % clients
+			renew, _ := dhcpv4.New(dhcpv4.WithHwAddr(macOf(n)), dhcpv4.WithClientIP(ips[n]), dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest))
+			ack, _ := dhcpv4.NewReplyFromRequest(renew)
+			if !o.Handle(context.Background(), "eth0", renew, ack) || ack.MessageType() == dhcpv4.MessageTypeNak {
+				b.Logf("RENEW of %s not acked", ips[n])
+				b.Fail()
+			}
+		}
+	})
+}
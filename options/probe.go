@@ -0,0 +1,161 @@
+package options
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Prober tells whether an IP is used already, by an ICMP echo or an ARP probe
+type Prober interface {
+	Probe(ctx context.Context, ip net.IP) (bool, error)
+}
+
+// Reply hands over a response done after HandleLater returned
+type Reply func(resp *dhcpv4.DHCPv4)
+
+// how many IPs a DISCOVER may probe before it's left unanswered
+const maxProbes = 3
+
+// how many DISCOVERs probe in the background at the same time
+const maxProbing = 64
+
+// SetProber makes the new IPs probed by p before they are offered, nil offers them unprobed
+func (o *Options) SetProber(p Prober) {
+	o.admin.Lock()
+	defer o.admin.Unlock()
+	o.prober = p
+}
+
+// probeOffer reports whether the new IP offered in resp may be sent now. With later nil
+// the IP is probed before it returns. Otherwise the probes run in the background, out of
+// the request workers, and later gets resp once a free IP is offered; the retransmissions
+// meanwhile are left to it, one probe runs per client. With the background probes all busy the IP is sent unprobed.
+func (o *Options) probeOffer(ctx context.Context, req, resp *dhcpv4.DHCPv4, idxSubnet int, later Reply) bool {
+	key, _ := clientKey(req)
+	unlock := o.lockClient(key)
+	rec, ok := o.records.get(key)
+	if !ok || !rec.probe || o.prober == nil {
+		unlock()
+		return ok
+	}
+	if later == nil {
+		unlock()
+		if !o.startProbe(key) {
+			return false
+		}
+		defer o.endProbe(key)
+		return o.probe(ctx, req, resp, idxSubnet)
+	}
+	if o.closed || ctx.Err() != nil {
+		unlock()
+		return false
+	}
+	select {
+	case o.probes <- struct{}{}:
+	default:
+		log.Warningf("Too many probes running, IP %s offered to client %s unprobed", rec.IP, key)
+		rec.probe = false
+		unlock()
+		return true
+	}
+	if !o.startProbe(key) {
+		<-o.probes
+		unlock()
+		return false
+	}
+	o.probing.Add(1)
+	unlock()
+
+	go func() {
+		defer o.probing.Done()
+		defer func() { <-o.probes }()
+		defer o.endProbe(key)
+		// the request context ends with the worker, the probes have their own timeout
+		if o.probe(context.Background(), req, resp, idxSubnet) {
+			later(resp)
+		}
+	}()
+	return false
+}
+
+// probe probes the IP offered to the client of req without holding the client lock, an
+// IP in use is abandoned and another one is offered. It reports whether resp holds an
+// offer of a free IP.
+func (o *Options) probe(ctx context.Context, req, resp *dhcpv4.DHCPv4, idxSubnet int) bool {
+	key, _ := clientKey(req)
+	for i := 0; ; i++ {
+		unlock := o.lockClient(key)
+		rec, ok := o.records.get(key)
+		if !ok || rec.state != leaseOffered {
+			unlock()
+			return false
+		}
+		if !rec.probe || o.prober == nil {
+			unlock()
+			return true
+		}
+		if i == maxProbes {
+			unlock()
+			log.Warningf("Client %s got %d IPs in use, no offer", key, maxProbes)
+			return false
+		}
+		prober, ip := o.prober, rec.IP
+		unlock()
+
+		inUse, err := prober.Probe(ctx, ip)
+		if err != nil && ctx.Err() == nil {
+			log.Warningf("Could not probe IP %s, offered anyway: %v", ip, err)
+		}
+		unlock = o.lockClient(key)
+		if cur, _ := o.records.get(key); cur != rec || rec.state != leaseOffered || ctx.Err() != nil {
+			// the client moved on while the IP was probed
+			unlock()
+			return false
+		}
+		if !inUse {
+			rec.probe = false
+			unlock()
+			return true
+		}
+		o.abandon(rec)
+		unlock()
+
+		if !o.Handler4(ctx, req, resp, idxSubnet) {
+			return false
+		}
+	}
+}
+
+// startProbe marks a probe of the client key running, false if one is already
+func (o *Options) startProbe(key string) bool {
+	o.probingMu.Lock()
+	defer o.probingMu.Unlock()
+	if o.probingKeys[key] {
+		return false
+	}
+	o.probingKeys[key] = true
+	return true
+}
+
+func (o *Options) endProbe(key string) {
+	o.probingMu.Lock()
+	defer o.probingMu.Unlock()
+	delete(o.probingKeys, key)
+}
+
+// abandon quarantines the offered IP of rec, something else answered on it
+func (o *Options) abandon(rec *Record) {
+	q := &Quarantine{
+		IP:      rec.IP,
+		Role:    rec.role,
+		Reason:  leaseAbandoned.String(),
+		Expires: time.Now().Add(o.quarantineTime).Round(time.Second),
+	}
+	o.quarantineIP(q)
+	// kept until the offer expires, so the retransmissions are known
+	rec.setState(leaseAbandoned)
+	log.Warningf("IP address %s is in use, abandoned until %v", rec.IP, q.Expires)
+}
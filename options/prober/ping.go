@@ -0,0 +1,98 @@
+package prober
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"minidhcp/base"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// how long to wait for the echo reply if not configured
+const defaultTimeout = 500 * time.Millisecond
+
+// protocol number of ICMP, for icmp.ParseMessage
+const protocolICMP = 1
+
+// Ping probes an IP with an ICMP echo, a reply means it's in use. It needs a raw socket.
+type Ping struct {
+	timeout time.Duration
+	id      int
+	seq     uint32
+}
+
+// New returns the prober configured by cfg.Probe
+func New(cfg *base.Config) (*Ping, error) {
+	if cfg.Probe != "ping" {
+		return nil, fmt.Errorf("unknown probe: %s", cfg.Probe)
+	}
+	timeout := defaultTimeout
+	if cfg.ProbeTimeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(cfg.ProbeTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe timeout: %v", cfg.ProbeTimeout)
+		}
+	}
+	return NewPing(timeout), nil
+}
+
+// NewPing returns a prober waiting timeout for the echo reply
+func NewPing(timeout time.Duration) *Ping {
+	return &Ping{timeout: timeout, id: os.Getpid() & 0xffff}
+}
+
+// Probe reports whether ip answers an echo request before the timeout
+func (p *Ping) Probe(ctx context.Context, ip net.IP) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	seq := int(atomic.AddUint32(&p.seq, 1) & 0xffff)
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: p.id, Seq: seq, Data: []byte("minidhcp")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+	if _, err = conn.WriteTo(b, &net.IPAddr{IP: ip}); err != nil {
+		return false, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return false, nil
+			}
+			return false, err
+		}
+		// the raw socket gets every ICMP message, only our echo reply counts
+		if a, ok := peer.(*net.IPAddr); !ok || !a.IP.Equal(ip) {
+			continue
+		}
+		m, err := icmp.ParseMessage(protocolICMP, buf[:n])
+		if err != nil || m.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := m.Body.(*icmp.Echo); ok && echo.ID == p.id && echo.Seq == seq {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package options
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"minidhcp/base"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// buckets kept per limit before the full ones are pruned
+	maxBuckets = 65536
+	// how often a role raises EventPoolDrain at most
+	drainAlarmInterval = time.Minute
+)
+
+// limit is a token bucket rate, burst tokens at most refilled at rate per second
+type limit struct {
+	rate  float64
+	burst float64
+}
+
+// parseLimit parses "count/duration" like 10/1m, nil if s is empty
+func parseLimit(s string) (*limit, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed rate limit: %s", s)
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("malformed rate limit count: %s", s)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return nil, fmt.Errorf("malformed rate limit duration: %s", s)
+	}
+	return &limit{rate: float64(count) / per.Seconds(), burst: float64(count)}, nil
+}
+
+// bucket holds the tokens left at last
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last refill
+func (l *limit) refill(b *bucket, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = l.burst
+	} else if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+	}
+	b.last = now
+}
+
+// buckets are the buckets of a limit, by client or relay
+type buckets struct {
+	*limit
+	all map[string]*bucket
+}
+
+func newBuckets(s string) (*buckets, error) {
+	l, err := parseLimit(s)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	return &buckets{limit: l, all: make(map[string]*bucket)}, nil
+}
+
+// get returns the refilled bucket of key, nil if there is no limit or key is empty
+func (bs *buckets) get(key string, now time.Time) *bucket {
+	if bs == nil || key == "" {
+		return nil
+	}
+	b, ok := bs.all[key]
+	if !ok {
+		if len(bs.all) >= maxBuckets {
+			bs.prune(now)
+		}
+		b = &bucket{}
+		bs.all[key] = b
+	}
+	bs.refill(b, now)
+	return b
+}
+
+// prune forgets the full buckets, a new bucket is full too
+func (bs *buckets) prune(now time.Time) {
+	for key, b := range bs.all {
+		bs.refill(b, now)
+		if b.tokens >= bs.burst {
+			delete(bs.all, key)
+		}
+	}
+}
+
+// limiter limits how fast a role leases new IPs, per client, per relay and in all
+type limiter struct {
+	clients *buckets
+	relays  *buckets
+	role    *limit
+	global  bucket
+	alarmed time.Time // last EventPoolDrain
+}
+
+func newLimiter(rl base.RateLimit) (*limiter, error) {
+	l := &limiter{}
+	var err error
+	if l.clients, err = newBuckets(rl.Client); err != nil {
+		return nil, err
+	}
+	if l.relays, err = newBuckets(rl.Relay); err != nil {
+		return nil, err
+	}
+	if l.role, err = parseLimit(rl.Role); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// allow takes a token of the client, of the relay and of the role, all or none. It
+// returns which one is out of tokens otherwise.
+func (l *limiter) allow(client, relay string, now time.Time) (bool, string) {
+	taken := []*bucket{}
+	if b := l.clients.get(client, now); b != nil {
+		if b.tokens < 1 {
+			return false, "client"
+		}
+		taken = append(taken, b)
+	}
+	if b := l.relays.get(relay, now); b != nil {
+		if b.tokens < 1 {
+			return false, "relay"
+		}
+		taken = append(taken, b)
+	}
+	if l.role != nil {
+		l.role.refill(&l.global, now)
+		if l.global.tokens < 1 {
+			return false, "role"
+		}
+		taken = append(taken, &l.global)
+	}
+	for _, b := range taken {
+		b.tokens--
+	}
+	return true, ""
+}
+
+// relayKey identifies the relay port of a relayed request, "" if it's not relayed
+func relayKey(req *dhcpv4.DHCPv4) string {
+	if req.GatewayIPAddr == nil || req.GatewayIPAddr.IsUnspecified() {
+		return ""
+	}
+	key := req.GatewayIPAddr.String()
+	if rai := req.RelayAgentInfo(); rai != nil {
+		key += "/" + string(rai.Get(dhcpv4.AgentCircuitIDSubOption))
+	}
+	return key
+}
+
+// allowNew reports whether the client of req may lease a new IP of role now. A role out
+// of tokens is drained abnormally fast, EventPoolDrain is raised.
+func (o *Options) allowNew(role *role, req *dhcpv4.DHCPv4) bool {
+	now := time.Now()
+	mac := req.ClientHWAddr.String()
+	role.mu.Lock()
+	ok, which := role.limiter.allow(mac, relayKey(req), now)
+	alarm := which == "role" && now.Sub(role.limiter.alarmed) >= drainAlarmInterval
+	if alarm {
+		role.limiter.alarmed = now
+	}
+	role.mu.Unlock()
+	if ok {
+		return true
+	}
+	log.Warningf("MAC %s refused a new IP of role %s, %s rate limit hit", mac, role.name, which)
+	if alarm {
+		o.emit(EventPoolDrain, &Record{mac: mac, role: role.name})
+	}
+	return false
+}
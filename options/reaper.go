@@ -0,0 +1,71 @@
+package options
+
+import (
+	"context"
+	"time"
+)
+
+// how often the reaper looks for expired leases
+const reapInterval = 10 * time.Second
+
+// Reap expires the bound leases over their time. Their IPs go back to the allocator once
+// the grace period is over. The released and declined records are dropped after the
+// grace period too. The offers and the quarantined IPs over their time go back on the
+// next pass, a pool running out asks for one right away. It returns when ctx is done.
+func (o *Options) Reap(ctx context.Context) {
+	log.Printf("Lease reaper started, grace period %v", o.leaseGrace)
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Lease reaper stopped")
+			return
+		case now := <-ticker.C:
+			o.reap(now)
+		case <-o.reapNow:
+			o.reap(time.Now())
+		}
+	}
+}
+
+// reap write locks admin, it doesn't wait for the writes of the expired leases
+func (o *Options) reap(now time.Time) {
+	o.admin.Lock()
+	defer o.admin.Unlock()
+	if o.closed {
+		return
+	}
+	for _, key := range o.records.keys() {
+		rec, ok := o.records.get(key)
+		if !ok {
+			continue
+		}
+		switch {
+		case rec.state == leaseBound && !rec.expires.After(now):
+			rec.setState(leaseExpired)
+			o.saveRecord(rec)
+			o.emit(EventLeaseExpired, rec)
+		case rec.state == leaseExpired && !rec.expires.Add(o.leaseGrace).After(now):
+			err := o.roles[o.roleIndex(rec.role)].free(rec.IP)
+			if err != nil {
+				log.Warningf("Free expired IP %s: %v", rec.IP, err)
+			}
+			o.dropRecord(key)
+			o.emit(EventLeaseReclaimed, rec)
+		case (rec.state == leaseReleased || rec.state == leaseDeclined) && !rec.expires.Add(o.leaseGrace).After(now):
+			// the IP is already back in the allocator or in quarantine
+			o.dropRecord(key)
+		}
+	}
+	o.expireOffers(now)
+	o.expireQuarantine(now)
+}
+
+// reapSoon asks the reaper for a pass now, without waiting for it
+func (o *Options) reapSoon() {
+	select {
+	case o.reapNow <- struct{}{}:
+	default:
+	}
+}
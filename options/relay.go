@@ -0,0 +1,22 @@
+package options
+
+import (
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// relayLink returns an IP on the network of the client as the relay tells it: the
+// link-selection sub-option of option 82 (RFC 3527) or giaddr. It's nil when the
+// request was not relayed.
+func relayLink(req *dhcpv4.DHCPv4) net.IP {
+	if rai := req.RelayAgentInfo(); rai != nil {
+		if ip := net.IP(rai.Get(dhcpv4.LinkSelectionSubOption)).To4(); ip != nil && !ip.IsUnspecified() {
+			return ip
+		}
+	}
+	if req.GatewayIPAddr != nil && !req.GatewayIPAddr.IsUnspecified() {
+		return req.GatewayIPAddr.To4()
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package options
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"minidhcp/base"
+	"minidhcp/options/allocators"
+	"minidhcp/options/allocators/bitmap"
+)
+
+// role is a configured role, its pools and the options handed to its clients
+type role struct {
+	name      string
+	subnet    base.Subnet
+	pools     []base.Pool
+	allocs    []allocators.Allocator // one per pool
+	leaseTime time.Duration
+	hosts     map[string]*host // reservations, by IP
+	limiter   *limiter         // of the new leases
+	mu        sync.Mutex       // of the allocators and the limiter
+}
+
+func newRole(sub base.Subnet) (*role, error) {
+	if sub.Role == "" {
+		return nil, errors.New("role without name")
+	}
+	r := &role{name: sub.Role, subnet: sub, pools: sub.Ranges(), hosts: make(map[string]*host)}
+	if len(r.pools) == 0 {
+		return nil, fmt.Errorf("role %s has no pool", sub.Role)
+	}
+	for _, pool := range r.pools {
+		alloc, err := createAllocator(pool.IpStart, pool.IpStop)
+		if err != nil {
+			return nil, fmt.Errorf("could not create an allocator for role %s: %w", sub.Role, err)
+		}
+		r.allocs = append(r.allocs, alloc)
+	}
+
+	leaseTime, err := time.ParseDuration(sub.LeaseTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lease duration of role %s: %v", sub.Role, sub.LeaseTime)
+	}
+	r.leaseTime = leaseTime
+	r.limiter, err = newLimiter(sub.Limits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid limits of role %s: %v", sub.Role, err)
+	}
+	return r, nil
+}
+
+func createAllocator(ipstart, ipend string) (allocators.Allocator, error) {
+	ipRangeStart := net.ParseIP(ipstart)
+	if ipRangeStart.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 address: %v", ipstart)
+	}
+	ipRangeEnd := net.ParseIP(ipend)
+	if ipRangeEnd.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 address: %v", ipend)
+	}
+	if binary.BigEndian.Uint32(ipRangeStart.To4()) >= binary.BigEndian.Uint32(ipRangeEnd.To4()) {
+		return nil, errors.New("start of IP range has to be lower than the end of an IP range")
+	}
+
+	allocator, err := bitmap.NewIPv4Allocator(ipRangeStart, ipRangeEnd)
+
+	return allocator, err
+}
+
+// poolIndex returns the pool holding ip, -1 if there is none
+func (r *role) poolIndex(ip net.IP) int {
+	if ip.To4() == nil {
+		return -1
+	}
+	n := binary.BigEndian.Uint32(ip.To4())
+	for i, pool := range r.pools {
+		start, stop := net.ParseIP(pool.IpStart).To4(), net.ParseIP(pool.IpStop).To4()
+		if n >= binary.BigEndian.Uint32(start) && n <= binary.BigEndian.Uint32(stop) {
+			return i
+		}
+	}
+	return -1
+}
+
+// overlap returns a pool of r and a pool of other sharing an IP, false if there is none
+func (r *role) overlap(other *role) (base.Pool, base.Pool, bool) {
+	bounds := func(p base.Pool) (uint32, uint32) {
+		return binary.BigEndian.Uint32(net.ParseIP(p.IpStart).To4()), binary.BigEndian.Uint32(net.ParseIP(p.IpStop).To4())
+	}
+	for _, p := range r.pools {
+		start, stop := bounds(p)
+		for _, q := range other.pools {
+			qstart, qstop := bounds(q)
+			if start <= qstop && qstart <= stop {
+				return p, q, true
+			}
+		}
+	}
+	return base.Pool{}, base.Pool{}, false
+}
+
+// overlapAny fails if a pool of r shares an IP with a pool of one of others, each role
+// has its own allocator, a shared IP would be leased twice
+func (r *role) overlapAny(others []*role) error {
+	for _, other := range others {
+		if p, q, ok := r.overlap(other); ok {
+			return fmt.Errorf("pool %s-%s of role %s overlaps pool %s-%s of role %s",
+				p.IpStart, p.IpStop, r.name, q.IpStart, q.IpStop, other.name)
+		}
+	}
+	return nil
+}
+
+// rangeContains reports whether ip is in one of the pools
+func (r *role) rangeContains(ip net.IP) bool {
+	return r.poolIndex(ip) >= 0
+}
+
+// subnetContains reports whether ip is on the network of the role
+func (r *role) subnetContains(ip net.IP) bool {
+	mask := net.IPMask(net.ParseIP(r.subnet.Netmask).To4())
+	start := net.ParseIP(r.pools[0].IpStart).To4()
+	if mask == nil || start == nil || ip.To4() == nil {
+		return false
+	}
+	return start.Mask(mask).Equal(ip.To4().Mask(mask))
+}
+
+// allocate takes the hinted IP if it's free, any free IP of the pools otherwise
+func (r *role) allocate(hint net.IP) (net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := r.poolIndex(hint); i >= 0 {
+		ip, err := r.allocs[i].Allocate(net.IPNet{IP: hint})
+		if err == nil {
+			return ip.IP.To4(), nil
+		}
+	}
+	for _, alloc := range r.allocs {
+		ip, err := alloc.Allocate(net.IPNet{})
+		if err == nil {
+			return ip.IP.To4(), nil
+		}
+	}
+	return nil, allocators.ErrNoAddrAvail
+}
+
+// reserve takes exactly ip, it fails if ip is taken or out of the pools
+func (r *role) reserve(ip net.IP) error {
+	i := r.poolIndex(ip)
+	if i < 0 {
+		return fmt.Errorf("IP %s is out of the pools of role %s", ip, r.name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	got, err := r.allocs[i].Allocate(net.IPNet{IP: ip})
+	if err != nil {
+		return err
+	}
+	if !got.IP.Equal(ip) {
+		r.allocs[i].Free(got)
+		return fmt.Errorf("IP %s is already taken", ip)
+	}
+	return nil
+}
+
+// free gives ip back to its pool, a reserved IP stays taken
+func (r *role) free(ip net.IP) error {
+	if _, ok := r.hosts[ip.String()]; ok {
+		return nil
+	}
+	i := r.poolIndex(ip)
+	if i < 0 {
+		return fmt.Errorf("IP %s is out of the pools of role %s", ip, r.name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.allocs[i].Free(net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"minidhcp/options"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// not in dhcpv4 yet, RFC 3203
+const messageTypeForceRenew dhcpv4.MessageType = 9
+
+// onEvent is subscribed to the options events, it's called with options locked
+func (s *Server) onEvent(ev options.Event) {
+	if ev.Type != options.EventForceRenew {
+		return
+	}
+	mac, err := net.ParseMAC(ev.Mac)
+	if err != nil {
+		log.Errorf("ForceRenew: %v", err)
+		return
+	}
+	l := s.listenerOf(ev.IP)
+	go func() {
+		if err := s.forceRenew(l, mac, ev.IP); err != nil {
+			log.Errorf("ForceRenew to MAC %s IP %s: %v", mac, ev.IP, err)
+		}
+	}()
+}
+
+// listenerOf returns the listener on the network of ip, the first one if there is none
+func (s *Server) listenerOf(ip net.IP) *listener {
+	for _, l := range s.listeners {
+		addrs, _ := l.iface.Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.Contains(ip) {
+				return l
+			}
+		}
+	}
+	return s.listeners[0]
+}
+
+// forceRenew tells the client at ip to renew its lease now, RFC 3203
+func (s *Server) forceRenew(l *listener, mac net.HardwareAddr, ip net.IP) error {
+	msg, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(mac),
+		dhcpv4.WithClientIP(ip),
+		dhcpv4.WithMessageType(messageTypeForceRenew),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(l.serverId)),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to build FORCERENEW: %v", err)
+	}
+	msg.OpCode = dhcpv4.OpcodeBootReply
+
+	peer := &net.UDPAddr{IP: ip, Port: dhcpv4.ClientPort}
+	if err = l.transport.WriteTo(msg.ToBytes(), 0, peer); err != nil {
+		return err
+	}
+	log.Infof("Sent FORCERENEW to MAC %s IP %s", mac, ip)
+	return nil
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// how many datagrams a MemTransport holds each way
+const memQueue = 64
+
+// Datagram is a DHCPv4 message carried by a MemTransport
+type Datagram struct {
+	Data    []byte
+	Src     *net.UDPAddr     // of a datagram delivered to the server
+	Dst     *net.UDPAddr     // of a datagram sent by the server
+	DstMAC  net.HardwareAddr // of a datagram sent in an Ethernet frame, nil otherwise
+	IfIndex int
+}
+
+// MemTransport is a Transport in memory, so the server runs without sockets: the clients
+// of a test Deliver their requests and Receive what the server sent
+type MemTransport struct {
+	iface  *net.Interface
+	in     chan Datagram
+	out    chan Datagram
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewMemTransport returns a MemTransport bound to iface, iface doesn't have to exist
+func NewMemTransport(iface *net.Interface) *MemTransport {
+	return &MemTransport{
+		iface:  iface,
+		in:     make(chan Datagram, memQueue),
+		out:    make(chan Datagram, memQueue),
+		closed: make(chan struct{}),
+	}
+}
+
+// Deliver hands d to the server, it fails once the transport is closed
+func (m *MemTransport) Deliver(d Datagram) error {
+	select {
+	case m.in <- d:
+		return nil
+	case <-m.closed:
+		return net.ErrClosed
+	}
+}
+
+// Receive returns the next datagram sent by the server, false if none is sent in timeout
+func (m *MemTransport) Receive(timeout time.Duration) (Datagram, bool) {
+	select {
+	case d := <-m.out:
+		return d, true
+	case <-time.After(timeout):
+		return Datagram{}, false
+	}
+}
+
+func (m *MemTransport) Interface() *net.Interface {
+	return m.iface
+}
+
+func (m *MemTransport) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	select {
+	case d := <-m.in:
+		var src net.Addr
+		if d.Src != nil {
+			src = d.Src
+		}
+		return copy(b, d.Data), d.IfIndex, src, nil
+	case <-m.closed:
+		return 0, 0, nil, net.ErrClosed
+	}
+}
+
+func (m *MemTransport) WriteTo(b []byte, ifindex int, dst *net.UDPAddr) error {
+	return m.send(Datagram{Data: append([]byte(nil), b...), Dst: dst, IfIndex: ifindex})
+}
+
+// WriteFrame decodes the frame, the datagram keeps its destination MAC
+func (m *MemTransport) WriteFrame(b []byte, ifindex int, dst net.HardwareAddr) error {
+	p := gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default)
+	eth, _ := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip, _ := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udp, _ := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if eth == nil || ip == nil || udp == nil {
+		return errors.New("not a UDP over IPv4 Ethernet frame")
+	}
+	return m.send(Datagram{
+		Data:    append([]byte(nil), udp.Payload...),
+		Dst:     &net.UDPAddr{IP: ip.DstIP, Port: int(udp.DstPort)},
+		DstMAC:  eth.DstMAC,
+		IfIndex: ifindex,
+	})
+}
+
+// send queues d for Receive, it's dropped like on a network when nobody reads
+func (m *MemTransport) send(d Datagram) error {
+	select {
+	case <-m.closed:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case m.out <- d:
+		return nil
+	default:
+		return errors.New("memory transport full, datagram dropped")
+	}
+}
+
+func (m *MemTransport) Close() error {
+	m.once.Do(func() { close(m.closed) })
+	return nil
+}
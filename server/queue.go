@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// workers handling the requests if not configured
+	defaultWorkers = 16
+	// requests waiting for a worker if not configured
+	defaultQueueSize = 1024
+	// how long a request may wait and be handled if not configured
+	defaultRequestTimeout = 2 * time.Second
+)
+
+// job is a received request waiting for a worker
+type job struct {
+	l        *listener
+	req      *dhcpv4.DHCPv4
+	ifindex  int // the request came in on, 0 if not known
+	src      net.Addr
+	key      string // retransmissions of the request share it
+	received time.Time
+}
+
+// jobKey is the same for the retransmissions of a request: the client keeps chaddr and xid,
+// the message type tells the REQUEST from the DISCOVER of the same exchange
+func jobKey(req *dhcpv4.DHCPv4) string {
+	return fmt.Sprintf("%s/%s/%s", req.ClientHWAddr, req.TransactionID, req.MessageType())
+}
+
+// queue holds the received requests for the workers. It's bounded, the oldest request is
+// dropped when it's full, and a retransmission of a request queued or being handled is
+// dropped too.
+type queue struct {
+	sync.Mutex
+	cond    *sync.Cond
+	jobs    []*job
+	size    int
+	pending map[string]bool // keys of the requests queued or being handled
+	closed  bool
+
+	dropped   uint64 // oldest requests dropped by a full queue
+	coalesced uint64 // retransmissions dropped
+}
+
+func newQueue(size int) *queue {
+	q := &queue{size: size, pending: make(map[string]bool)}
+	q.cond = sync.NewCond(&q.Mutex)
+	return q
+}
+
+// push queues j, it returns the request dropped to make room, nil if none, and false
+// if j was dropped as a retransmission or the queue is closed
+func (q *queue) push(j *job) (*job, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return nil, false
+	}
+	if q.pending[j.key] {
+		q.coalesced++
+		return nil, false
+	}
+	var oldest *job
+	if len(q.jobs) >= q.size {
+		oldest = q.jobs[0]
+		q.jobs[0] = nil
+		q.jobs = q.jobs[1:]
+		delete(q.pending, oldest.key)
+		q.dropped++
+	}
+	q.jobs = append(q.jobs, j)
+	q.pending[j.key] = true
+	q.cond.Signal()
+	return oldest, true
+}
+
+// pop waits for a request, false once the queue is closed and empty
+func (q *queue) pop() (*job, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.jobs) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.jobs) == 0 {
+		return nil, false
+	}
+	j := q.jobs[0]
+	q.jobs[0] = nil
+	q.jobs = q.jobs[1:]
+	return j, true
+}
+
+// done forgets j, a retransmission of it is handled again
+func (q *queue) done(j *job) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.pending, j.key)
+}
+
+// close makes pop return false once the queued requests are taken
+func (q *queue) close() {
+	q.Lock()
+	defer q.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// stats returns the count of the dropped and the coalesced requests
+func (q *queue) stats() (dropped, coalesced uint64) {
+	q.Lock()
+	defer q.Unlock()
+	return q.dropped, q.coalesced
+}
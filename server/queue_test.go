@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func newJob(t *testing.T, mac byte, typ dhcpv4.MessageType) *job {
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(net.HardwareAddr{0, 0, 0, 0, 0, mac}),
+		dhcpv4.WithTransactionID(dhcpv4.TransactionID{0, 0, 0, mac}),
+		dhcpv4.WithMessageType(typ),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &job{req: req, key: jobKey(req)}
+}
+
+func TestQueue(t *testing.T) {
+	tests := []struct {
+		name      string
+		push      []*job
+		want      []string // keys popped, in order
+		dropped   uint64
+		coalesced uint64
+	}{
+		{
+			name: "fifo",
+			push: []*job{newJob(t, 1, dhcpv4.MessageTypeDiscover), newJob(t, 2, dhcpv4.MessageTypeDiscover)},
+			want: []string{"00:00:00:00:00:01/0x00000001/DISCOVER", "00:00:00:00:00:02/0x00000002/DISCOVER"},
+		},
+		{
+			name: "drop oldest",
+			push: []*job{newJob(t, 1, dhcpv4.MessageTypeDiscover), newJob(t, 2, dhcpv4.MessageTypeDiscover),
+				newJob(t, 3, dhcpv4.MessageTypeDiscover), newJob(t, 4, dhcpv4.MessageTypeDiscover)},
+			want:    []string{"00:00:00:00:00:02/0x00000002/DISCOVER", "00:00:00:00:00:03/0x00000003/DISCOVER", "00:00:00:00:00:04/0x00000004/DISCOVER"},
+			dropped: 1,
+		},
+		{
+			name:      "coalesce retransmission",
+			push:      []*job{newJob(t, 1, dhcpv4.MessageTypeDiscover), newJob(t, 1, dhcpv4.MessageTypeDiscover)},
+			want:      []string{"00:00:00:00:00:01/0x00000001/DISCOVER"},
+			coalesced: 1,
+		},
+		{
+			name: "request of the same exchange",
+			push: []*job{newJob(t, 1, dhcpv4.MessageTypeDiscover), newJob(t, 1, dhcpv4.MessageTypeRequest)},
+			want: []string{"00:00:00:00:00:01/0x00000001/DISCOVER", "00:00:00:00:00:01/0x00000001/REQUEST"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQueue(3)
+			for _, j := range tt.push {
+				q.push(j)
+			}
+			q.close()
+			var got []string
+			for j, ok := q.pop(); ok; j, ok = q.pop() {
+				got = append(got, j.key)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("popped %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("popped %v, want %v", got, tt.want)
+				}
+			}
+			if dropped, coalesced := q.stats(); dropped != tt.dropped || coalesced != tt.coalesced {
+				t.Fatalf("dropped %d coalesced %d, want %d %d", dropped, coalesced, tt.dropped, tt.coalesced)
+			}
+		})
+	}
+}
+
+func TestQueueDone(t *testing.T) {
+	q := newQueue(3)
+	j := newJob(t, 1, dhcpv4.MessageTypeDiscover)
+	q.push(j)
+	j, _ = q.pop()
+	// still being handled
+	if _, ok := q.push(newJob(t, 1, dhcpv4.MessageTypeDiscover)); ok {
+		t.Fatal("retransmission of a request being handled queued")
+	}
+	q.done(j)
+	if _, ok := q.push(newJob(t, 1, dhcpv4.MessageTypeDiscover)); !ok {
+		t.Fatal("retransmission of a handled request dropped")
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// how often a dropped datagram or a skipped read error is logged at most
+const recvLogInterval = 10 * time.Second
+
+// reqFromRecv4 reads the next request on l. Malformed datagrams and transient read errors
+// are counted, logged at a rate limit and skipped, an error means the socket is unusable.
+func (s *Server) reqFromRecv4(l *listener) (*dhcpv4.DHCPv4, int, net.Addr, error) {
+	bp := bufpool.Get().(*[]byte)
+	defer bufpool.Put(bp)
+	for {
+		b := (*bp)[:MaxDatagram] //Reslice to max capacity in case the buffer in pool was resliced smaller
+
+		log.Printf("Transport.ReadFrom wating...")
+
+		n, ifindex, src, err := l.transport.ReadFrom(b)
+		log.Printf("Transport.ReadFrom: %d", n)
+		if err != nil {
+			if s.ctx.Err() != nil || !isTransient(err) {
+				return nil, 0, nil, err
+			}
+			s.recvLog.Warningf("Skipped read error on %s: %v", l.iface.Name, err)
+			continue
+		}
+
+		// new req from recv buf
+		req, err := dhcpv4.FromBytes(b[:n])
+		if err != nil {
+			atomic.AddUint64(&s.parseErrors, 1)
+			s.recvLog.Warningf("Dropped malformed DHCPv4 datagram of %d bytes from %v: %v", n, src, err)
+			continue
+		}
+		return req, ifindex, src, nil
+	}
+}
+
+// ParseErrors returns how many malformed datagrams were dropped
+func (s *Server) ParseErrors() uint64 {
+	return atomic.LoadUint64(&s.parseErrors)
+}
+
+// isTransient reports whether the socket is still usable after the read error err
+func isTransient(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.EAGAIN, syscall.EINTR, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// rateLog logs a warning once per recvLogInterval at most, with the count of the dropped ones
+type rateLog struct {
+	sync.Mutex
+	last    time.Time
+	dropped int
+}
+
+func (r *rateLog) Warningf(format string, args ...interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	if now.Sub(r.last) < recvLogInterval {
+		r.dropped++
+		return
+	}
+	if r.dropped > 0 {
+		log.Warningf("%d similar warnings suppressed in the last %v", r.dropped, now.Sub(r.last).Round(time.Second))
+	}
+	log.Warningf(format, args...)
+	r.last, r.dropped = now, 0
+}
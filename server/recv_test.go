@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"golang.org/x/net/ipv4"
+)
+
+func TestRecvMalformed(t *testing.T) {
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &udpTransport{conn: ipv4.NewPacketConn(udp), iface: &net.Interface{Name: "lo"}}
+	l := &listener{transport: tr, iface: tr.iface}
+	s := &Server{}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	defer s.cancel()
+
+	client, err := net.DialUDP("udp4", nil, udp.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	discover, _ := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0, 0, 0, 0, 1})
+	for _, b := range [][]byte{{0xde, 0xad}, make([]byte, 300), discover.ToBytes()} {
+		if _, err := client.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the malformed datagrams are skipped, the next request is read
+	req, _, src, err := s.reqFromRecv4(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.TransactionID != discover.TransactionID || src == nil {
+		t.Fatalf("read %v from %v", req, src)
+	}
+	if n := s.ParseErrors(); n != 2 {
+		t.Fatalf("%d parse errors, want 2", n)
+	}
+
+	// a closed socket is fatal
+	l.transport.Close()
+	if _, _, _, err := s.reqFromRecv4(l); err == nil || isTransient(err) {
+		t.Fatalf("read on a closed socket: %v", err)
+	}
+}
@@ -3,21 +3,27 @@ package server
 import (
 	"fmt"
 	"net"
-	"syscall"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/insomniacslk/dhcp/dhcpv4"
-	"golang.org/x/net/ipv4"
 )
 
-func (s *Server) makePeer(req, resp *dhcpv4.DHCPv4) (peer *net.UDPAddr, isSendPcap bool) {
+// makePeer returns where resp goes, src is where req came from
+func (s *Server) makePeer(req, resp *dhcpv4.DHCPv4, src net.Addr) (peer *net.UDPAddr, isSendPcap bool) {
 	isSendPcap = false
 	var ip net.IP
 	var port int
 	if !req.GatewayIPAddr.IsUnspecified() {
-		// TODO: make RFC8357 compliant
 		ip, port = req.GatewayIPAddr, dhcpv4.ServerPort
+		if udp, ok := src.(*net.UDPAddr); ok && udp.Port != 0 && hasRelaySourcePort(req) {
+			// the relay listens on the port it sent from, RFC 8357 5.
+			port = udp.Port
+		}
+		if resp.MessageType() == dhcpv4.MessageTypeNak {
+			// the relay has to broadcast NAK to the client, RFC 2131 4.3.2
+			resp.SetBroadcast()
+		}
 	} else if resp.MessageType() == dhcpv4.MessageTypeNak {
 		ip, port = net.IPv4bcast, dhcpv4.ClientPort
 	} else if !req.ClientIPAddr.IsUnspecified() {
@@ -34,46 +40,57 @@ func (s *Server) makePeer(req, resp *dhcpv4.DHCPv4) (peer *net.UDPAddr, isSendPc
 	return
 }
 
-func (s *Server) sendResp(req, resp *dhcpv4.DHCPv4, oob *ipv4.ControlMessage) {
+// hasRelaySourcePort reports whether the relay set the relay source port sub-option
+func hasRelaySourcePort(req *dhcpv4.DHCPv4) bool {
+	rai := req.RelayAgentInfo()
+	return rai != nil && rai.Has(dhcpv4.RelaySourcePortSubOption)
+}
+
+// sendResp sends resp out of the interface of l, where req came in on recvIndex
+func (s *Server) sendResp(l *listener, req, resp *dhcpv4.DHCPv4, recvIndex int, src net.Addr) {
 	// Direct broadcasts, link-local and layer2 unicasts to the interface the request was received on.
 	// Other packets should use the normal routing table in case of asymetric routing
 	// if peer.IP.Equal(net.IPv4bcast) || peer.IP.IsLinkLocalUnicast() || useEthernet {
 	var ifindex int
-	if s.iface.Index != 0 {
-		ifindex = s.iface.Index
-	} else if oob != nil && oob.IfIndex != 0 {
-		ifindex = oob.IfIndex
+	if l.iface.Index != 0 {
+		ifindex = l.iface.Index
+	} else if recvIndex != 0 {
+		ifindex = recvIndex
 	} else {
 		log.Println("HandleMsg4: Did not receive interface information")
 	}
 
-	peer, isSendPcap := s.makePeer(req, resp)
+	peer, isSendPcap := s.makePeer(req, resp, src)
 
 	if isSendPcap {
-		intf, err := net.InterfaceByIndex(ifindex)
-		if err != nil {
-			log.Errorf("SendResp: Error get IfIndex %d %v", ifindex, err)
-			return
+		intf := l.iface
+		if intf.Index != ifindex {
+			var err error
+			intf, err = net.InterfaceByIndex(ifindex)
+			if err != nil {
+				log.Errorf("SendResp: Error get IfIndex %d %v", ifindex, err)
+				return
+			}
+			log.Printf("InterfaceByIndex %v %v", ifindex, intf)
 		}
-		log.Printf("InterfaceByIndex %v", ifindex, intf)
-		err = s.sendEthernet(*intf, resp)
+		err := s.sendEthernet(l, *intf, resp)
 		if err != nil {
 			log.Errorf("SendResp: Error send Ethernet packet: %v", err)
 		}
 	} else {
-		woob := &ipv4.ControlMessage{IfIndex: ifindex} // ip4.conn 不使用cm oob
-		n, err := s.conn.WriteTo(resp.ToBytes(), woob, peer)
+		err := l.transport.WriteTo(resp.ToBytes(), ifindex, peer)
 		if err != nil {
-			log.Errorf("SendResp: Error conn.Write %s bytes to %v failed: %v", n, peer, err)
+			log.Errorf("SendResp: Error %v", err)
 		}
 	}
 }
 
 //this function sends an unicast to the hardware address defined in resp.ClientHWAddr,
 //the layer3 destination address is still the broadcast address;
+//l: the listener whose transport sends the frame;
 //iface: the interface where the DHCP message should be sent;
 //resp: DHCPv4 struct, which should be sent;
-func (s *Server) sendEthernet(iface net.Interface, resp *dhcpv4.DHCPv4) error {
+func (s *Server) sendEthernet(l *listener, iface net.Interface, resp *dhcpv4.DHCPv4) error {
 
 	eth := layers.Ethernet{
 		EthernetType: layers.EthernetTypeIPv4,
@@ -120,36 +137,5 @@ func (s *Server) sendEthernet(iface net.Interface, resp *dhcpv4.DHCPv4) error {
 	if err != nil {
 		return fmt.Errorf("Cannot serialize layer: %v, %v, %v, %v", err, eth, ip, udp)
 	}
-	data := buf.Bytes()
-
-	// domain :=
-	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
-	if err != nil {
-		return fmt.Errorf("Send Ethernet: Cannot open socket: %v", err)
-	}
-	defer func() {
-		err = syscall.Close(fd)
-		if err != nil {
-			log.Errorf("Send Ethernet: Cannot close socket: %v", err)
-		}
-	}()
-
-	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
-	if err != nil {
-		log.Errorf("Send Ethernet: Cannot set option for socket: %v", err)
-	}
-
-	var hwAddr [8]byte
-	copy(hwAddr[0:6], resp.ClientHWAddr[0:6])
-	ethAddr := syscall.SockaddrLinklayer{
-		Protocol: 0,
-		Ifindex:  iface.Index,
-		Halen:    6,
-		Addr:     hwAddr, //not used
-	}
-	err = syscall.Sendto(fd, data, 0, &ethAddr)
-	if err != nil {
-		return fmt.Errorf("Cannot send frame via socket: %v", err)
-	}
-	return nil
+	return l.transport.WriteFrame(buf.Bytes(), iface.Index, resp.ClientHWAddr)
 }
@@ -1,21 +1,23 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sync"
-
-	"golang.org/x/net/ipv4"
+	"time"
 
 	"minidhcp/base"
 	"minidhcp/options"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
-	"github.com/insomniacslk/dhcp/dhcpv4/server4"
 )
 
 const MaxDatagram = 1 << 16
 
+// how long the requests in flight may take to finish on shutdown
+const drainTimeout = 5 * time.Second
+
 var log = base.GetLogger("server")
 
 // buffer pool for recv & send
@@ -27,102 +29,219 @@ var bufpool = sync.Pool{
 }
 
 type Server struct {
-	conn   *ipv4.PacketConn
-	iface  *net.Interface
-	opts   *options.Options // core for dhcp's options add/update
-	errors chan error
+	listeners []*listener      // one per served interface
+	opts      *options.Options // core for dhcp's options add/update
+	errors    chan error
+	ctx       context.Context // done when the server shuts down
+	cancel    context.CancelFunc
+	inflight  sync.WaitGroup // listen loops and workers
+
+	queue          *queue
+	workers        int
+	requestTimeout time.Duration
+
+	parseErrors uint64  // malformed datagrams dropped, atomic
+	recvLog     rateLog // of the dropped datagrams and the read errors skipped
+	queueLog    rateLog // of the requests dropped by the queue
 }
 
-// Wait waits until the end of the execution of the server.
+// listener serves one interface, responses leave through it
+type listener struct {
+	transport Transport
+	iface     *net.Interface
+	serverId  net.IP
+}
+
+// Wait waits until the end of the execution of the server: a fatal error, or the context
+// of Start done. It stops reading and waits for the requests in flight, at most drainTimeout.
 func (s *Server) Wait() error {
 	log.Debug("Waiting")
-	err := <-s.errors
+	var err error
+	select {
+	case err = <-s.errors:
+	case <-s.ctx.Done():
+		log.Printf("Shutting down DHCPv4 server")
+	}
 
-	s.conn.Close()
+	s.close()
+	s.drain()
 
 	return err
 }
 
+func (s *Server) close() {
+	s.cancel()
+	for _, l := range s.listeners {
+		l.transport.Close()
+	}
+	if s.queue != nil {
+		s.queue.close()
+	}
+}
+
+// drain waits for the listen loops and the workers to finish, the requests still queued
+// are dropped, their context is done
+func (s *Server) drain() {
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Printf("DHCPv4 server stopped")
+	case <-time.After(drainTimeout):
+		log.Warningf("Requests still in flight after %v, abandoned", drainTimeout)
+	}
+}
+
+// fail hands err to Wait, unless the server is shutting down already
+func (s *Server) fail(err error) {
+	select {
+	case s.errors <- err:
+	case <-s.ctx.Done():
+	}
+}
+
 // server asynchronously start. See `Wait` to wait until the execution ends.
-func Start(cfg *base.Config) (*Server, error) {
+// The server shuts down when ctx is done.
+func Start(ctx context.Context, cfg *base.Config, opts *options.Options) (*Server, error) {
+	return StartWith(ctx, cfg, opts, ListenUDP)
+}
+
+// StartWith is Start on the transports opened by listen
+func StartWith(ctx context.Context, cfg *base.Config, opts *options.Options, listen Listen) (*Server, error) {
 	log.Println("Starting DHCPv4 server")
-	// init ops = load options prepare dhcp options recv send
+	// ops = loaded options prepare dhcp options recv send
 	srv := &Server{}
-	srv.opts = options.New(cfg)
-
-	// init conn,iface = ipv4.PacketConn, multicast ip
-	addr := cfg.Address()
-	udpConn, err := server4.NewIPv4UDPConn(addr.Zone, &addr)
-	if err != nil {
+	srv.opts = opts
+	srv.ctx, srv.cancel = context.WithCancel(ctx)
+	if err := srv.setupWorkers(cfg); err != nil {
 		return srv, err
 	}
-	srv.conn = ipv4.NewPacketConn(udpConn)
-	srv.iface, err = net.InterfaceByName(addr.Zone)
-	if err != nil {
-		srv.conn.Close()
-		return srv, fmt.Errorf("DHCPv4: Listen could not find interface %s: %v", addr.Zone, err)
-	}
 
-	if addr.IP.IsMulticast() {
-		err = srv.conn.JoinGroup(srv.iface, &addr)
+	for _, ifc := range cfg.Ifaces() {
+		l, err := newListener(cfg, ifc, listen)
 		if err != nil {
-			srv.conn.Close()
+			srv.close()
 			return srv, err
 		}
+		srv.listeners = append(srv.listeners, l)
 	}
 
 	srv.errors = make(chan error)
+	opts.Subscribe(srv.onEvent)
 
-	go srv.listen()
+	for i := 0; i < srv.workers; i++ {
+		srv.inflight.Add(1)
+		go srv.work()
+	}
+	for _, l := range srv.listeners {
+		srv.inflight.Add(1)
+		go srv.listen(l)
+	}
 
-	return srv, err
+	return srv, nil
 }
 
-func (s *Server) reqFromRecv4() (*dhcpv4.DHCPv4, *ipv4.ControlMessage) {
-	b := *bufpool.Get().(*[]byte)
-	b = b[:MaxDatagram] //Reslice to max capacity in case the buffer in pool was resliced smaller
-
-	log.Printf("ipv4.PacketConn.ReadFrom wating...")
-
-	n, oob, _, err := s.conn.ReadFrom(b)
-	log.Printf("ipv4.PacketConn.ReadFrom: %d", n)
-	if err != nil {
-		log.Errorf("Error reading from connection: %v", err)
-		s.errors <- err
+// setupWorkers sizes the worker pool and its queue by cfg
+func (s *Server) setupWorkers(cfg *base.Config) error {
+	s.workers, s.requestTimeout = defaultWorkers, defaultRequestTimeout
+	size := defaultQueueSize
+	if cfg.Workers > 0 {
+		s.workers = cfg.Workers
 	}
+	if cfg.QueueSize > 0 {
+		size = cfg.QueueSize
+	}
+	if cfg.RequestTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.RequestTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid request timeout: %v", cfg.RequestTimeout)
+		}
+		s.requestTimeout = timeout
+	}
+	s.queue = newQueue(size)
+	return nil
+}
 
-	// new req from recv buf
-	b = b[:n]
-	req, err := dhcpv4.FromBytes(b)
-	bufpool.Put(&b)
+// newListener opens the transport of the interface ifc by listen
+func newListener(cfg *base.Config, ifc base.Interface, listen Listen) (*listener, error) {
+	t, err := listen(cfg, ifc)
 	if err != nil {
-		log.Printf("Error parsing DHCPv4 request: %v", err)
-		s.errors <- err
+		return nil, err
 	}
-	return req, oob
+	return &listener{transport: t, iface: t.Interface(), serverId: net.ParseIP(ifc.ServerId).To4()}, nil
 }
 
-func (s *Server) listen() {
-	log.Printf("Listen %s", s.conn.LocalAddr())
+func (s *Server) listen(l *listener) {
+	defer s.inflight.Done()
+	log.Printf("Serving DHCPv4 on %s", l.iface.Name)
 	for {
-		req, oob := s.reqFromRecv4()
+		req, ifindex, src, err := s.reqFromRecv4(l)
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("Error reading from connection on %s: %v", l.iface.Name, err)
+			s.fail(err)
+			return
+		}
 		log.Printf("reqFromRecv4: %v", req)
-		go func() {
-			// pretranslate req and oob
-			resp, err := s.respFromReq4(req, oob)
-			if err != nil {
-				log.Println(err)
-				return
-			}
+		j := &job{l: l, req: req, ifindex: ifindex, src: src, key: jobKey(req), received: time.Now()}
+		oldest, queued := s.queue.push(j)
+		if !queued {
+			log.Debugf("Retransmission %s is handled already, dropped", j.key)
+		}
+		if oldest != nil {
+			dropped, _ := s.queue.stats()
+			s.queueLog.Warningf("Queue full, dropped request %s, %d dropped so far", oldest.key, dropped)
+		}
+	}
+}
 
-			s.opts.Handle(req, resp)
+// work handles the queued requests until the queue is closed
+func (s *Server) work() {
+	defer s.inflight.Done()
+	for {
+		j, ok := s.queue.pop()
+		if !ok {
+			return
+		}
+		s.handle(j)
+		s.queue.done(j)
+	}
+}
 
-			s.sendResp(req, resp, oob)
-		}()
+// handle answers the request of j, unless it waited past its deadline
+func (s *Server) handle(j *job) {
+	ctx, cancel := context.WithDeadline(s.ctx, j.received.Add(s.requestTimeout))
+	defer cancel()
+	if ctx.Err() != nil {
+		s.queueLog.Warningf("Request %s waited %v, dropped", j.key, time.Since(j.received).Round(time.Millisecond))
+		return
+	}
+
+	// pretranslate req
+	resp, err := s.respFromReq4(j.req)
+	if err != nil {
+		log.Println(err)
+		return
 	}
+
+	// an offer whose IP is probed first goes out when the probe is done, the worker
+	// goes on meanwhile
+	later := func(resp *dhcpv4.DHCPv4) {
+		s.sendResp(j.l, j.req, resp, j.ifindex, j.src)
+	}
+	if !s.opts.HandleLater(ctx, j.l.iface.Name, j.req, resp, later) {
+		return
+	}
+
+	s.sendResp(j.l, j.req, resp, j.ifindex, j.src)
 }
 
-func (s *Server) respFromReq4(req *dhcpv4.DHCPv4, oob *ipv4.ControlMessage) (resp *dhcpv4.DHCPv4, err error) {
+func (s *Server) respFromReq4(req *dhcpv4.DHCPv4) (resp *dhcpv4.DHCPv4, err error) {
 	// verify: constants that represent valid values for OpcodeType
 	if req.OpCode != dhcpv4.OpcodeBootRequest {
 		err = fmt.Errorf("RecvMsg4: unsupported opcode %d. Only support %d", req.OpCode, dhcpv4.OpcodeBootRequest)
@@ -140,8 +259,11 @@ func (s *Server) respFromReq4(req *dhcpv4.DHCPv4, oob *ipv4.ControlMessage) (res
 	switch mt := req.MessageType(); mt {
 	case dhcpv4.MessageTypeDiscover:
 		optType = dhcpv4.MessageTypeOffer
-	case dhcpv4.MessageTypeRequest:
+	case dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeInform:
 		optType = dhcpv4.MessageTypeAck
+	case dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		// no reply for release and decline, options only records them
+		return
 	default:
 		err = fmt.Errorf("Unhandled message type: %v", mt)
 		return
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"minidhcp/base"
+	"minidhcp/options"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var (
+	serverId = net.IPv4(192, 0, 2, 1).To4()
+	relayIP  = net.IPv4(192, 0, 2, 254).To4()
+)
+
+// startMem starts a server on a MemTransport for eth0
+func startMem(t *testing.T) (*MemTransport, *options.Options) {
+	dir := t.TempDir()
+	cfg := &base.Config{
+		ServerId:   serverId.String(),
+		Interfaces: []base.Interface{{Name: "eth0"}},
+		LeasePath:  filepath.Join(dir, "lease.txt"),
+		AuditLog:   filepath.Join(dir, "audit.log"),
+		Workers:    4,
+		Roles: []base.Subnet{
+			{Role: "staff", IpStart: "192.0.2.10", IpStop: "192.0.2.20", Netmask: "255.255.255.0", LeaseTime: "3600s",
+				Router: "192.0.2.1", Dns: "192.0.2.1"},
+		},
+	}
+	opts, err := options.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := NewMemTransport(&net.Interface{Name: "eth0", Index: 100, HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 0xfe}})
+	listen := func(*base.Config, base.Interface) (Transport, error) { return mem, nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv, err := StartWith(ctx, cfg, opts, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		if err := srv.Wait(); err != nil {
+			t.Error(err)
+		}
+		opts.Close()
+	})
+	return mem, opts
+}
+
+// testClient is a synthetic DHCPv4 client on a MemTransport
+type testClient struct {
+	t   *testing.T
+	mem *MemTransport
+	mac net.HardwareAddr
+	ip  net.IP // offered or acked last
+}
+
+// exchange delivers req and returns the reply with its xid, nil if there is none
+func (c *testClient) exchange(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, Datagram) {
+	src := &net.UDPAddr{IP: req.ClientIPAddr, Port: dhcpv4.ClientPort}
+	if !req.GatewayIPAddr.IsUnspecified() {
+		src = &net.UDPAddr{IP: req.GatewayIPAddr, Port: dhcpv4.ServerPort}
+	}
+	if err := c.mem.Deliver(Datagram{Data: req.ToBytes(), Src: src}); err != nil {
+		c.t.Fatal(err)
+	}
+	timeout := 2 * time.Second
+	if req.MessageType() == dhcpv4.MessageTypeRelease {
+		// no reply is sent, give it the time to be handled
+		timeout = 100 * time.Millisecond
+	}
+	for {
+		d, ok := c.mem.Receive(timeout)
+		if !ok {
+			return nil, Datagram{}
+		}
+		resp, err := dhcpv4.FromBytes(d.Data)
+		if err != nil {
+			c.t.Fatalf("malformed reply: %v", err)
+		}
+		if resp.TransactionID == req.TransactionID {
+			return resp, d
+		}
+	}
+}
+
+func (c *testClient) new(typ dhcpv4.MessageType, mods ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	mods = append([]dhcpv4.Modifier{dhcpv4.WithHwAddr(c.mac), dhcpv4.WithMessageType(typ)}, mods...)
+	req, err := dhcpv4.New(mods...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return req
+}
+
+func discover(broadcast bool) func(c *testClient) *dhcpv4.DHCPv4 {
+	return func(c *testClient) *dhcpv4.DHCPv4 {
+		return c.new(dhcpv4.MessageTypeDiscover, dhcpv4.WithBroadcast(broadcast))
+	}
+}
+
+// selecting requests the offered IP
+func selecting(c *testClient) *dhcpv4.DHCPv4 {
+	return c.new(dhcpv4.MessageTypeRequest, dhcpv4.WithBroadcast(true),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(c.ip)), dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverId)))
+}
+
+// renewing unicasts the lease in ciaddr
+func renewing(c *testClient) *dhcpv4.DHCPv4 {
+	return c.new(dhcpv4.MessageTypeRequest, dhcpv4.WithClientIP(c.ip))
+}
+
+// rebinding broadcasts the lease in ciaddr
+func rebinding(c *testClient) *dhcpv4.DHCPv4 {
+	return c.new(dhcpv4.MessageTypeRequest, dhcpv4.WithClientIP(c.ip), dhcpv4.WithBroadcast(true))
+}
+
+// initReboot verifies ip after a reboot
+func initReboot(ip net.IP) func(c *testClient) *dhcpv4.DHCPv4 {
+	return func(c *testClient) *dhcpv4.DHCPv4 {
+		return c.new(dhcpv4.MessageTypeRequest, dhcpv4.WithBroadcast(true), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))
+	}
+}
+
+func release(c *testClient) *dhcpv4.DHCPv4 {
+	return c.new(dhcpv4.MessageTypeRelease, dhcpv4.WithClientIP(c.ip))
+}
+
+// relayed is req forwarded by the relay at relayIP
+func relayed(req func(c *testClient) *dhcpv4.DHCPv4) func(c *testClient) *dhcpv4.DHCPv4 {
+	return func(c *testClient) *dhcpv4.DHCPv4 {
+		r := req(c)
+		r.GatewayIPAddr = relayIP
+		r.HopCount = 1
+		return r
+	}
+}
+
+// step is a request of the client and the reply it gets
+type step struct {
+	req   func(c *testClient) *dhcpv4.DHCPv4
+	want  dhcpv4.MessageType         // MessageTypeNone if there is no reply
+	dst   func(c *testClient) net.IP // where the reply is sent
+	port  int                        // of dst, the client port if 0
+	frame bool                       // the reply is an Ethernet frame to chaddr
+}
+
+func broadcast(*testClient) net.IP  { return net.IPv4bcast }
+func clientIP(c *testClient) net.IP { return c.ip }
+func relay(*testClient) net.IP      { return relayIP }
+
+// lease runs DISCOVER and REQUEST to a bound lease
+var lease = []step{
+	{req: discover(true), want: dhcpv4.MessageTypeOffer, dst: broadcast},
+	{req: selecting, want: dhcpv4.MessageTypeAck, dst: broadcast},
+}
+
+func TestServer(t *testing.T) {
+	mem, _ := startMem(t)
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"allocation", lease},
+		{"allocation without broadcast", []step{
+			{req: discover(false), want: dhcpv4.MessageTypeOffer, dst: clientIP, frame: true},
+			{req: selecting, want: dhcpv4.MessageTypeAck, dst: broadcast},
+		}},
+		{"renew", append(lease[:2:2],
+			step{req: renewing, want: dhcpv4.MessageTypeAck, dst: clientIP},
+		)},
+		{"rebind", append(lease[:2:2],
+			step{req: rebinding, want: dhcpv4.MessageTypeAck, dst: clientIP},
+		)},
+		{"release", append(lease[:2:2],
+			step{req: release, want: dhcpv4.MessageTypeNone},
+			// the released IP is no longer the client's
+			step{req: renewing, want: dhcpv4.MessageTypeNak, dst: broadcast},
+		)},
+		{"init-reboot on the wrong network", []step{
+			{req: initReboot(net.IPv4(198, 51, 100, 10)), want: dhcpv4.MessageTypeNak, dst: broadcast},
+		}},
+		{"selecting an IP never offered", []step{
+			{req: discover(true), want: dhcpv4.MessageTypeOffer, dst: broadcast},
+			{req: func(c *testClient) *dhcpv4.DHCPv4 {
+				c.ip = net.IPv4(192, 0, 2, 99)
+				return selecting(c)
+			}, want: dhcpv4.MessageTypeNak, dst: broadcast},
+		}},
+		{"relayed", []step{
+			{req: relayed(discover(false)), want: dhcpv4.MessageTypeOffer, dst: relay, port: dhcpv4.ServerPort},
+			{req: relayed(selecting), want: dhcpv4.MessageTypeAck, dst: relay, port: dhcpv4.ServerPort},
+		}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &testClient{t: t, mem: mem, mac: net.HardwareAddr{2, 0, 0, 0, 0, byte(i + 1)}}
+			for n, st := range tt.steps {
+				req := st.req(c)
+				resp, d := c.exchange(req)
+				if st.want == dhcpv4.MessageTypeNone {
+					if resp != nil {
+						t.Fatalf("step %d: %v got %v, want no reply", n, req.MessageType(), resp.MessageType())
+					}
+					continue
+				}
+				if resp == nil || resp.MessageType() != st.want {
+					t.Fatalf("step %d: %v got %v, want %v", n, req.MessageType(), resp, st.want)
+				}
+				if st.want != dhcpv4.MessageTypeNak {
+					if !resp.ServerIdentifier().Equal(serverId) {
+						t.Fatalf("step %d: server identifier %v", n, resp.ServerIdentifier())
+					}
+					if c.ip != nil && st.want == dhcpv4.MessageTypeAck && !resp.YourIPAddr.Equal(c.ip) {
+						t.Fatalf("step %d: ACK of %s, want %s", n, resp.YourIPAddr, c.ip)
+					}
+					c.ip = resp.YourIPAddr
+				}
+
+				port := st.port
+				if port == 0 {
+					port = dhcpv4.ClientPort
+				}
+				if dst := st.dst(c); !d.Dst.IP.Equal(dst) || d.Dst.Port != port {
+					t.Fatalf("step %d: %v sent to %v, want %s:%d", n, resp.MessageType(), d.Dst, dst, port)
+				}
+				if (d.DstMAC != nil) != st.frame || (st.frame && d.DstMAC.String() != c.mac.String()) {
+					t.Fatalf("step %d: %v sent in a frame to %v", n, resp.MessageType(), d.DstMAC)
+				}
+			}
+		})
+	}
+}
+
+// blockedProber finds every IP free once released
+type blockedProber chan struct{}
+
+func (p blockedProber) Probe(ctx context.Context, ip net.IP) (bool, error) {
+	select {
+	case <-p:
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func TestProbeOffer(t *testing.T) {
+	mem, opts := startMem(t)
+	release := make(blockedProber)
+	opts.SetProber(release)
+
+	// as many DISCOVERs as workers, their probes don't hold them
+	var xids []dhcpv4.TransactionID
+	for i := 0; i < 4; i++ {
+		c := &testClient{t: t, mem: mem, mac: net.HardwareAddr{2, 0, 0, 0, 1, byte(i)}}
+		req := discover(true)(c)
+		xids = append(xids, req.TransactionID)
+		if err := mem.Deliver(Datagram{Data: req.ToBytes(), Src: &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &testClient{t: t, mem: mem, mac: net.HardwareAddr{2, 0, 0, 0, 2, 0}}
+	inform := c.new(dhcpv4.MessageTypeInform, dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 99)))
+	if resp, _ := c.exchange(inform); resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("INFORM got %v while the offers were probed", resp)
+	}
+
+	// the offers go out once probed, without a retransmission
+	close(release)
+	offered := make(map[dhcpv4.TransactionID]bool)
+	for len(offered) < len(xids) {
+		d, ok := mem.Receive(2 * time.Second)
+		if !ok {
+			t.Fatalf("%d of %d offers sent", len(offered), len(xids))
+		}
+		resp, err := dhcpv4.FromBytes(d.Data)
+		if err != nil || resp.MessageType() != dhcpv4.MessageTypeOffer || !resp.ServerIdentifier().Equal(serverId) {
+			t.Fatalf("got %v %v, want an offer", resp, err)
+		}
+		offered[resp.TransactionID] = true
+	}
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"net"
+
+	"minidhcp/base"
+)
+
+// Transport carries the DHCPv4 datagrams of one served interface
+type Transport interface {
+	// Interface returns the interface the transport is bound to
+	Interface() *net.Interface
+	// ReadFrom reads the next datagram into b, ifindex is the interface it came in on,
+	// 0 if it's not known
+	ReadFrom(b []byte) (n, ifindex int, src net.Addr, err error)
+	// WriteTo sends b to dst by UDP, out of the interface ifindex if it's not 0
+	WriteTo(b []byte, ifindex int, dst *net.UDPAddr) error
+	// WriteFrame sends the Ethernet frame b to the hardware address dst out of the
+	// interface ifindex, for a client that has no IP yet
+	WriteFrame(b []byte, ifindex int, dst net.HardwareAddr) error
+	// Close unblocks ReadFrom and releases the transport
+	Close() error
+}
+
+// Listen opens the transport of the served interface ifc
+type Listen func(cfg *base.Config, ifc base.Interface) (Transport, error)
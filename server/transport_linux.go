@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"minidhcp/base"
+
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"golang.org/x/net/ipv4"
+)
+
+// udpTransport receives and sends by a UDP socket bound to the interface, the frames
+// go out of an AF_PACKET socket
+type udpTransport struct {
+	conn  *ipv4.PacketConn
+	iface *net.Interface
+}
+
+// ListenUDP opens the UDP socket of the served interface ifc, it's the Listen of Start
+func ListenUDP(cfg *base.Config, ifc base.Interface) (Transport, error) {
+	// init conn,iface = ipv4.PacketConn, multicast ip
+	addr := cfg.Address(ifc.Name)
+	udpConn, err := server4.NewIPv4UDPConn(addr.Zone, &addr)
+	if err != nil {
+		return nil, err
+	}
+	t := &udpTransport{conn: ipv4.NewPacketConn(udpConn)}
+	t.iface, err = net.InterfaceByName(addr.Zone)
+	if err != nil {
+		t.conn.Close()
+		return nil, fmt.Errorf("DHCPv4: Listen could not find interface %s: %v", addr.Zone, err)
+	}
+
+	if addr.IP.IsMulticast() {
+		err = t.conn.JoinGroup(t.iface, &addr)
+		if err != nil {
+			t.conn.Close()
+			return nil, err
+		}
+	}
+	log.Printf("Listen %s on %s", t.conn.LocalAddr(), t.iface.Name)
+	return t, nil
+}
+
+func (t *udpTransport) Interface() *net.Interface {
+	return t.iface
+}
+
+func (t *udpTransport) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := t.conn.ReadFrom(b)
+	ifindex := 0
+	if cm != nil {
+		ifindex = cm.IfIndex
+	}
+	return n, ifindex, src, err
+}
+
+func (t *udpTransport) WriteTo(b []byte, ifindex int, dst *net.UDPAddr) error {
+	var cm *ipv4.ControlMessage
+	if ifindex != 0 {
+		cm = &ipv4.ControlMessage{IfIndex: ifindex}
+	}
+	n, err := t.conn.WriteTo(b, cm, dst)
+	if err != nil {
+		return fmt.Errorf("conn.Write %d bytes to %v failed: %v", n, dst, err)
+	}
+	return nil
+}
+
+// WriteFrame sends b by a raw AF_PACKET socket opened for the frame
+func (t *udpTransport) WriteFrame(b []byte, ifindex int, dst net.HardwareAddr) error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return fmt.Errorf("Send Ethernet: Cannot open socket: %v", err)
+	}
+	defer func() {
+		if err := syscall.Close(fd); err != nil {
+			log.Errorf("Send Ethernet: Cannot close socket: %v", err)
+		}
+	}()
+
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err != nil {
+		log.Errorf("Send Ethernet: Cannot set option for socket: %v", err)
+	}
+
+	var hwAddr [8]byte
+	copy(hwAddr[0:6], dst[0:6])
+	ethAddr := syscall.SockaddrLinklayer{
+		Protocol: 0,
+		Ifindex:  ifindex,
+		Halen:    6,
+		Addr:     hwAddr, //not used
+	}
+	err = syscall.Sendto(fd, b, 0, &ethAddr)
+	if err != nil {
+		return fmt.Errorf("Cannot send frame via socket: %v", err)
+	}
+	return nil
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}